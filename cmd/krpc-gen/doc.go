@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"unicode"
+
+	. "github.com/dave/jennifer/jen"
+)
+
+// Doc is a documentation string from a service definition. kRPC documents
+// services in the C# XML documentation format:
+//
+//	<doc>
+//	<summary>
+//	Uses time acceleration to warp forward to a time in the future, specified
+//	by universal time <paramref name="ut" />.
+//	</summary>
+//	<param name="ut">The universal time to warp to, in seconds.</param>
+//	<returns>When the time warp is complete.</returns>
+//	</doc>
+type Doc struct {
+	Summary string
+	Remarks string
+	Returns string
+	Params  []DocParam
+}
+
+// DocParam is the documentation of a parameter, by its converted name.
+type DocParam struct {
+	Name, Text string
+}
+
+// ParseDoc parses an XML documentation string, converting references to the
+// names of generated Go identifiers. Parameter names are converted with
+// param. Malformed documentation is returned as the summary.
+func ParseDoc(doc string, param func(string) string) Doc {
+	var parsed Doc
+	var text *string
+	var paramText string
+	var paramName string
+
+	decoder := xml.NewDecoder(strings.NewReader(doc))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "summary":
+				text = &parsed.Summary
+			case "remarks":
+				text = &parsed.Remarks
+			case "returns":
+				text = &parsed.Returns
+			case "param":
+				paramName = param(attr(t, "name"))
+				paramText = ""
+				text = &paramText
+			case "see":
+				if text != nil {
+					*text += crefName(attr(t, "cref"))
+				}
+			case "paramref":
+				if text != nil {
+					*text += param(attr(t, "name"))
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "summary", "remarks", "returns":
+				text = nil
+			case "param":
+				parsed.Params = append(parsed.Params, DocParam{Name: paramName, Text: collapse(paramText)})
+				text = nil
+			}
+		case xml.CharData:
+			if text != nil {
+				*text += string(t)
+			}
+		}
+	}
+
+	if parsed.Summary == "" && parsed.Remarks == "" && parsed.Returns == "" && len(parsed.Params) == 0 {
+		parsed.Summary = stripTags(doc)
+	}
+	parsed.Summary = collapse(parsed.Summary)
+	parsed.Remarks = collapse(parsed.Remarks)
+	parsed.Returns = collapse(parsed.Returns)
+	return parsed
+}
+
+// Comment renders the documentation as a Go doc comment for the identifier
+// name, which the summary is rewritten to start with. verb is used to start a
+// summary that is a noun phrase, such as "returns" for a property getter or
+// "provides" for a service; if it is empty, such summaries are left as they
+// are.
+//
+// Documentation with only parameters or a return value is rendered without a
+// summary, and empty documentation is not rendered at all.
+func (d Doc) Comment(name, verb string) Code {
+	var paragraphs []string
+	if d.Summary != "" {
+		paragraphs = append(paragraphs, wrap(sentence(name, verb, d.Summary), width))
+	}
+	if d.Remarks != "" {
+		paragraphs = append(paragraphs, wrap(d.Remarks, width))
+	}
+	if len(d.Params) > 0 {
+		var params []string
+		for _, p := range d.Params {
+			if p.Text == "" {
+				continue
+			}
+			// Indent continuation lines to line up with the text.
+			text := wrap(p.Name+": "+p.Text, width-4)
+			params = append(params, "  - "+strings.Replace(text, "\n", "\n    ", -1))
+		}
+		if len(params) > 0 {
+			paragraphs = append(paragraphs, "Parameters:\n"+strings.Join(params, "\n"))
+		}
+	}
+	if d.Returns != "" {
+		paragraphs = append(paragraphs, wrap("Returns "+lowerFirst(d.Returns), width))
+	}
+	if len(paragraphs) == 0 {
+		return Null()
+	}
+	return comment(strings.Join(paragraphs, "\n\n"))
+}
+
+// DocComment renders text as a Go doc comment.
+func DocComment(text string) Code {
+	return comment(wrap(text, width))
+}
+
+// comment renders lines of text as a line comment.
+func comment(text string) Code {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		lines = append(lines, strings.TrimRight("// "+line, " "))
+	}
+	return Comment(strings.Join(lines, "\n"))
+}
+
+// sentence rewrites a summary to start with name, as godoc expects.
+func sentence(name, verb, summary string) string {
+	words := strings.SplitN(summary, " ", 3)
+	first := words[0]
+	switch {
+	case first == name:
+		return summary
+	case first == "This" && len(words) == 3 && !isVerb(words[1]) && isVerb(strings.SplitN(words[2], " ", 2)[0]):
+		// "This service provides ..." names the identifier itself.
+		return name + " " + words[2]
+	case isWord(first) && isVerb(first):
+		return name + " " + lowerFirst(summary)
+	case verb != "" && (nounPhrase(first) || isWord(first)):
+		return name + " " + verb + " " + lowerFirst(summary)
+	}
+	return name + ": " + summary
+}
+
+// isVerb reports whether word looks like a verb in the third person, such as
+// "Returns".
+func isVerb(word string) bool {
+	switch word {
+	case "This", "Is", "Its", "Was", "Has":
+		return false
+	}
+	return strings.HasSuffix(word, "s")
+}
+
+// nounPhrase reports whether a summary starting with word describes a value
+// rather than an action.
+func nounPhrase(word string) bool {
+	switch word {
+	case "The", "A", "An", "Whether", "How", "Which":
+		return true
+	}
+	return false
+}
+
+// isWord reports whether word is an ordinary capitalised word, rather than an
+// identifier or acronym that must keep its case.
+func isWord(word string) bool {
+	runes := []rune(word)
+	if len(runes) < 2 || !unicode.IsUpper(runes[0]) {
+		return false
+	}
+	for _, r := range runes[1:] {
+		if !unicode.IsLower(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerFirst(s string) string {
+	first := strings.SplitN(s, " ", 2)[0]
+	if !isWord(first) && !nounPhrase(first) {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// crefName converts a documentation reference, such as
+// "M:SpaceCenter.Vessel.Flight" or "T:SpaceCenter.Flight", into the name of the
+// generated Go identifier, such as "Vessel.Flight" or "Flight". Service
+// members keep their service name, such as "SpaceCenter.ActiveVessel".
+func crefName(cref string) string {
+	kind := ""
+	if i := strings.Index(cref, ":"); i >= 0 {
+		kind, cref = cref[:i], cref[i+1:]
+	}
+	parts := strings.Split(cref, ".")
+	if kind == "T" || len(parts) < 2 {
+		// Types.
+		return parts[len(parts)-1]
+	}
+	// Service and class members.
+	return strings.Join(parts[len(parts)-2:], ".")
+}
+
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// stripTags removes XML tags from malformed documentation.
+func stripTags(s string) string {
+	var stripped []rune
+	inTag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+		case !inTag:
+			stripped = append(stripped, r)
+		}
+	}
+	return string(stripped)
+}
+
+// collapse collapses runs of whitespace into single spaces.
+func collapse(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// width is the width that comment text is wrapped to, so that it fits in 80
+// columns once indented and commented.
+const width = 74
+
+// wrap wraps text to width columns.
+func wrap(text string, width int) string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
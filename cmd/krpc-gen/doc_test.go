@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/dave/jennifer/jen"
+)
+
+// render renders generated code as a string.
+func render(c Code) string {
+	return fmt.Sprintf("%#v", c)
+}
+
+func TestDocComment(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{
+			doc:  `<doc><summary>The current universal time in seconds.</summary></doc>`,
+			want: "// UT returns the current universal time in seconds.",
+		},
+		{
+			doc:  `<doc><param name="ut">The time to warp to.</param></doc>`,
+			want: "// Parameters:\n//   - ut: The time to warp to.",
+		},
+		{
+			doc:  `<doc><returns>The vessel.</returns></doc>`,
+			want: "// Returns the vessel.",
+		},
+		{
+			doc:  `<doc></doc>`,
+			want: "",
+		},
+	}
+	for _, test := range tests {
+		got := render(ParseDoc(test.doc, noParams).Comment("UT", "returns"))
+		if got != test.want {
+			t.Errorf("Comment(%q) = %q, want %q", test.doc, got, test.want)
+		}
+	}
+}
+
+func TestServiceComment(t *testing.T) {
+	tests := []struct {
+		summary string
+		want    string
+	}{
+		{"Provides functionality to interact with Kerbal Space Program.", "// SpaceCenter provides functionality to interact with Kerbal Space Program."},
+		{"This service provides functionality to interact with Kerbal Space Program.", "// SpaceCenter provides functionality to interact with Kerbal Space Program."},
+		{"Space center.", "// SpaceCenter provides space center."},
+		{"SpaceCenter is the main service.", "// SpaceCenter is the main service."},
+	}
+	for _, test := range tests {
+		doc := "<doc><summary>" + test.summary + "</summary></doc>"
+		got := render(ParseDoc(doc, noParams).Comment("SpaceCenter", "provides"))
+		if got != test.want {
+			t.Errorf("Comment(%q) = %q, want %q", test.summary, got, test.want)
+		}
+	}
+}
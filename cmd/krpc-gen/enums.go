@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/dave/jennifer/jen"
+	"github.com/ilikebits/jeb/cmd/krpc-gen/service"
+)
+
+// GenerateEnumeration generates an enumeration type with a constant for each
+// of its declared values, named with the enumeration as a prefix, along with
+// methods to convert it to and from its name and a codec that rejects values
+// the service did not declare.
+func GenerateEnumeration(file *File, enum string, definition service.Enumeration) {
+	// Declare enumeration type. Enumerations are encoded as sint32.
+	file.Add(ParseDoc(definition.Documentation, noParams).Comment(enum, "is"))
+	file.Type().Id(enum).Int32()
+
+	// Define enumeration values.
+	var defs []Code
+	for _, value := range definition.Values {
+		defs = append(defs,
+			ParseDoc(value.Documentation, noParams).Comment(enum+value.Name, "is"),
+			Id(enum+value.Name).Id(enum).Op("=").Lit(value.Value),
+		)
+	}
+	file.Const().Defs(defs...)
+
+	recv := receiverName(enum)
+
+	// Define String.
+	var names []Code
+	for _, value := range definition.Values {
+		names = append(names, Case(Id(enum+value.Name)).Block(Return(Lit(value.Name))))
+	}
+	file.Add(DocComment("String returns the name of the value, as declared by the service."))
+	file.Func().Params(Id(recv).Id(enum)).Id("String").Params().String().Block(
+		Switch(Id(recv)).Block(names...),
+		Return(Qual("fmt", "Sprintf").Call(Lit(enum+"(%d)"), Int32().Call(Id(recv)))),
+	)
+
+	// Define IsValid.
+	var values []Code
+	for _, value := range definition.Values {
+		values = append(values, Id(enum+value.Name))
+	}
+	file.Add(DocComment("IsValid reports whether the value was declared by the service."))
+	isValid := Switch(Id(recv)).Block(
+		Case(values...).Block(Return(True())),
+	)
+	if len(values) == 0 {
+		isValid = Null()
+	}
+	file.Func().Params(Id(recv).Id(enum)).Id("IsValid").Params().Bool().Block(
+		isValid,
+		Return(False()),
+	)
+
+	// Define Parse.
+	var parses []Code
+	for _, value := range definition.Values {
+		parses = append(parses, Case(Lit(value.Name)).Block(Return(Id(enum+value.Name), Nil())))
+	}
+	file.Add(DocComment(fmt.Sprintf("Parse%s returns the %s value with the given name.", enum, enum)))
+	file.Func().Id("Parse"+enum).Params(Id("name").String()).Params(Id(enum), Error()).Block(
+		Switch(Id("name")).Block(parses...),
+		Return(Lit(-1), Qual("fmt", "Errorf").Call(Lit("invalid "+enum+" %q"), Id("name"))),
+	)
+
+	// Define text marshalling, which is also used for JSON.
+	file.Add(DocComment("MarshalText encodes the value as its name."))
+	file.Func().Params(Id(recv).Id(enum)).Id("MarshalText").Params().Params(Index().Byte(), Error()).Block(
+		If(Op("!").Id(recv).Dot("IsValid").Call()).Block(
+			Return(Nil(), Qual("fmt", "Errorf").Call(Lit("invalid "+enum+" %d"), Int32().Call(Id(recv)))),
+		),
+		Return(Index().Byte().Call(Id(recv).Dot("String").Call()), Nil()),
+	)
+	file.Add(DocComment("UnmarshalText decodes the value from its name."))
+	file.Func().Params(Id(recv).Op("*").Id(enum)).Id("UnmarshalText").Params(Id("text").Index().Byte()).Error().Block(
+		List(Id("parsed"), Err()).Op(":=").Id("Parse"+enum).Call(String().Call(Id("text"))),
+		If(Err().Op("!=").Nil()).Block(Return(Err())),
+		Op("*").Id(recv).Op("=").Id("parsed"),
+		Return(Nil()),
+	)
+
+	// Define codec.
+	file.Func().Id("Encode" + enum).Params(Id("v").Id(enum)).Index().Byte().Block(
+		Return(Qual(krpcImportPath, "EncodeEnum").Call(Int32().Call(Id("v")))),
+	)
+	file.Add(DocComment(fmt.Sprintf("Decode%s decodes a %s, returning an error for values the service did not declare.", enum, enum)))
+	file.Func().Id("Decode"+enum).Params(Id("b").Index().Byte()).Params(Id(enum), Error()).Block(
+		List(Id("decoded"), Err()).Op(":=").Qual(krpcImportPath, "DecodeEnum").Call(Id("b")),
+		If(Err().Op("!=").Nil()).Block(Return(Lit(-1), Err())),
+		Id("v").Op(":=").Id(enum).Call(Id("decoded")),
+		If(Op("!").Id("v").Dot("IsValid").Call()).Block(
+			Return(Lit(-1), Qual("fmt", "Errorf").Call(Lit("invalid "+enum+" %d"), Id("decoded"))),
+		),
+		Return(Id("v"), Nil()),
+	)
+}
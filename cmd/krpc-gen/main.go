@@ -9,432 +9,667 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	. "github.com/dave/jennifer/jen"
 	"github.com/ilikebits/jeb/cmd/krpc-gen/service"
+	"github.com/ilikebits/jeb/krpc/pb"
 )
 
 const (
 	protoImportPath    = "github.com/golang/protobuf/proto"
 	wrappersImportPath = "github.com/golang/protobuf/ptypes/wrappers"
 	pbImportPath       = "github.com/ilikebits/jeb/krpc/pb"
+	krpcImportPath     = "github.com/ilikebits/jeb/krpc"
 )
 
 func main() {
 	// Parse flags.
-	dir := flag.String("dir", "", "directory of JSON service definitions (required)")
+	dir := flag.String("dir", "", "directory of JSON service definitions")
+	fromServer := flag.String("from-server", "", "address of a kRPC server to read service definitions from, such as 127.0.0.1:50000")
+	fromPB := flag.String("from-pb", "", "file containing an encoded Services message to read service definitions from")
+	writePB := flag.String("write-pb", "", "with -from-server, also save the server's Services message to a file for -from-pb")
 	out := flag.String("out", "", "import path of generated package")
+	packages := flag.Bool("packages", false, "generate each service into its own package under -out, such as krpc/spacecenter, instead of into the krpc package")
+	tuples := flag.String("tuples", "", `JSON file mapping tuple signatures, such as "(DOUBLE, DOUBLE, DOUBLE)", to struct names`)
 	flag.Parse()
 
 	// Validate flags.
-	if *dir == "" {
+	sources := 0
+	for _, source := range []string{*dir, *fromServer, *fromPB} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		fmt.Fprintln(os.Stderr, "exactly one of -dir, -from-server and -from-pb is required")
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *writePB != "" && *fromServer == "" {
+		fmt.Fprintln(os.Stderr, "-write-pb requires -from-server")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Read tuple mappings.
+	if *tuples != "" {
+		contents, err := ioutil.ReadFile(*tuples)
+		if err != nil {
+			panic(err)
+		}
+		err = json.Unmarshal(contents, &tupleMappings)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *packages {
+		servicePackages = *out
+		if servicePackages == "" {
+			servicePackages = krpcImportPath
+		}
+	}
 
-	// List service definitions.
-	ls, err := ioutil.ReadDir(*dir)
+	// Read service definitions.
+	var services service.Services
+	var err error
+	switch {
+	case *fromServer != "":
+		var msg *pb.Services
+		msg, services, err = ReadServer(*fromServer)
+		if err == nil && *writePB != "" {
+			err = WritePB(*writePB, msg)
+		}
+	case *fromPB != "":
+		services, err = ReadPB(*fromPB)
+	default:
+		services, err = ReadDir(*dir)
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	for _, file := range ls {
-		// Read service definition.
-		contents, err := ioutil.ReadFile(filepath.Join(*dir, file.Name()))
+	// renderPath returns the import path to save the package at path in.
+	renderPath := func(path string) string {
+		if *out == "" || servicePackages == "" {
+			return *out
+		}
+		return path
+	}
+
+	// Generate service clients.
+	for _, serviceName := range sortedServices(services) {
+		file := GenerateService(serviceName, services[serviceName])
+		Render(file, "generated_"+strings.ToLower(serviceName)+"_service.go", renderPath(servicePath(serviceName)))
+	}
+
+	// Generate the tuple structs used by all services, since the same tuple
+	// may occur in more than one service.
+	tupleFiles := GenerateTuples()
+	for _, path := range sortedPaths(tupleFiles) {
+		Render(tupleFiles[path], "generated_tuples.go", renderPath(path))
+	}
+}
+
+// servicePackages is the import path under which each service is generated
+// into its own package, or empty if every service is generated into the krpc
+// package.
+var servicePackages string
+
+// servicePath returns the import path of the package generated for a service.
+// Service packages are named after their service in lower case, such as
+// spacecenter for SpaceCenter.
+func servicePath(serviceName string) string {
+	if servicePackages == "" {
+		return krpcImportPath
+	}
+	return servicePackages + "/" + strings.ToLower(serviceName)
+}
+
+// Render saves file as name in the package at import path out, creating the
+// package directory if needed, or prints it if out is empty.
+func Render(file *File, name, out string) {
+	if out != "" {
+		dir := filepath.Join(os.Getenv("GOPATH"), "src", out)
+		err := os.MkdirAll(dir, 0755)
 		if err != nil {
 			panic(err)
 		}
-
-		// Parse service definition.
-		var services service.Services
-		err = json.Unmarshal(contents, &services)
+		err = file.Save(filepath.Join(dir, name))
 		if err != nil {
 			panic(err)
 		}
+		return
+	}
 
-		// Generate service client.
-		for serviceName, definition := range services {
-			// Compute method tables.
-			//
-			// > Procedures names are CamelCase. Whether a procedure is a service
-			// > procedure, class method, class property, and what class (if any) it
-			// > belongs to is determined by its name:
-			// >
-			// > * `ProcedureName` - a standard procedure that is just part of a
-			//     service.
-			// > * `get_PropertyName` - a procedure that returns the value of a
-			//     property in a service.
-			// > * `set_PropertyName` - a procedure that sets the value of a property
-			//     in a service.
-			// > * `ClassName_MethodName` - a class method.
-			// > * `ClassName_static_StaticMethodName` - a static class method.
-			// > * `ClassName_get_PropertyName` - a class property getter.
-			// > * `ClassName_set_PropertyName` - a class property setter.
-			// >
-			// > Only letters and numbers are permitted in class, method and property
-			// > names. Underscores can therefore be used to split the name into its
-			// > constituent parts.
-			classes := make(map[string]bool)
-			for class := range definition.Classes {
-				classes[class] = true
-			}
-			statics := make(map[string]map[string]service.Procedure)
-			methods := make(map[string]map[string]service.Procedure)
-			for name, proc := range definition.Procedures {
-				// Parse procedure name.
-				splits := strings.Split(name, "_")
-				if len(splits) < 2 {
-					continue
-				}
-				class := splits[0]
-				_, ok := classes[class]
-				if !ok {
-					continue
-				}
-				// Select table and ensure it's non-nil.
-				var table map[string]service.Procedure
-				if splits[1] == "static" {
-					table = statics[class]
-					if table == nil {
-						statics[class] = make(map[string]service.Procedure)
-						table = statics[class]
-					}
-				} else {
-					table = methods[class]
-					if table == nil {
-						methods[class] = make(map[string]service.Procedure)
-						table = methods[class]
-					}
-				}
-				// Set procedure.
-				table[name] = proc
-			}
+	divider := strings.Repeat("-", 80)
+	fmt.Printf("Generating %s:\n", name)
+	fmt.Println(divider)
 
-			// New file.
-			file := NewFilePath("github.com/ilikebits/jeb/krpc")
+	var rendered bytes.Buffer
+	err := file.Render(&rendered)
+	var annotated string
+	for i, line := range strings.Split(rendered.String(), "\n") {
+		annotated += fmt.Sprintf("%4d | %s\n", i+1, strings.Replace(line, "\t", "  ", -1))
+	}
+	fmt.Println(annotated)
 
-			// Service singleton.
-			file.Type().Id(serviceName).Struct(
-				Id("conn").Op("*").Id("Conn"),
-			)
+	if err != nil {
+		// Special case: make debugging formatting errors easier.
+		msg := err.Error()
+		if strings.Contains(msg, "while formatting source:") {
+			splits := strings.Split(msg, "while formatting source:")
 
-			// Classes.
-			for class := range definition.Classes {
-				// Define class struct.
-				file.Type().Id(class).Struct(
-					Id("conn").Op("*").Id("Conn"), // Should this be a reference back to the service instead?
-					Id("id").Uint64(),
-				)
-
-				// Define static class struct and methods.
-				if len(statics[class]) > 0 {
-					file.Type().Id(class + "Static").Struct(
-						Id("conn").Op("*").Id("Conn"),
-					)
-					for name, proc := range statics[class] {
-						// Take idiomatic parameters.
-						var params []Code
-						var args []Code
-						var marshallers [][]Code
-						for i, param := range proc.Parameters {
-							info := GenerateType(param.Type)
-							marshalled, marshal := info.Marshal(param.Name)
-
-							params = append(params, Id(param.Name).Add(info.Type))
-							args = append(args, Op("&").Qual(pbImportPath, "Argument").Values(Dict{
-								Id("Position"): Lit(i),
-								Id("Value"):    marshalled,
-							}))
-							marshallers = append(marshallers, marshal)
-						}
-
-						static := file.Func().Params(
-							Id("static").Op("*").Id(class + "Static"),
-						).Id(strings.TrimPrefix(name, class+"_static_")).Params(params...)
-
-						// Generate return type.
-						var returns []Code
-						var zeros []Code
-						var unmarshaller TypeGenerator
-						if proc.ReturnType.Code != "" {
-							info := GenerateType(proc.ReturnType)
-							returns = append(returns, info.Type)
-							zeros = append(zeros, info.Zero)
-							unmarshaller = info.Unmarshal
-						}
-						returns = append(returns, Error())
-						static.Params(returns...)
-
-						errReturn := If(Err().Op("!=").Nil().Block(Return(append(zeros, Err())...)))
-
-						// Generate method body.
-						var block []Code
-						// Marshal arguments.
-						for _, marshal := range marshallers {
-							if len(marshal) > 0 {
-								block = append(block, marshal...)
-								block = append(block, errReturn)
-							}
-						}
-						// Construct request.
-						block = append(block, Id("req").Op(":=").Qual(pbImportPath, "Request").Values(Dict{
-							Id("Calls"): Index().Op("*").Qual(pbImportPath, "ProcedureCall").Values(
-								Op("&").Qual(pbImportPath, "ProcedureCall").Values(Dict{
-									Id("Service"):           Lit(serviceName),
-									Id("service.Procedure"): Lit(name),
-									Id("Arguments"):         Index().Op("*").Qual(pbImportPath, "Argument").Values(List(args...)),
-								}),
-							),
-						}))
-						// Make request.
-						block = append(block,
-							List(Id("_"), Err()).Op("=").
-								Id("static").Dot("conn").Dot("Send").Call(Op("&").Id("req")))
-						block = append(block, errReturn)
-						// Read response.
-						block = append(block, Id("res").Op(":=").Qual(pbImportPath, "Response").Values())
-						block = append(block, Err().Op("=").Id("static").Dot("conn").Dot("Read").Call(Op("&").Id("res")))
-						block = append(block, errReturn)
-						block = append(block, If(Id("e").Op(":=").Id("res").Dot("GetError").Call(), Id("e").Op("!=").Nil()).Block(
-							Return(append(zeros, Qual("errors", "New").Call(Id("e").Dot("GetDescription").Call()))...),
-						))
-						// Unmarshal result.
-						if len(returns) == 1 {
-							continue
-						}
-						// Return result errors.
-						block = append(block, Id("result").Op(":=").Id("res").Dot("GetResults").Call().Index(Lit(0)))
-						block = append(block, If(Id("e").Op(":=").Id("result").Dot("GetError").Call(), Id("e").Op("!=").Nil()).Block(
-							Return(append(zeros, Qual("errors", "New").Call(Id("e").Dot("GetDescription").Call()))...),
-						))
-						// Unmarshal result bytes.
-						block = append(block, Id("resultBytes").Op(":=").Id("result").Dot("GetValue").Call())
-						result, steps := unmarshaller("resultBytes")
-						block = append(block, steps...)
-						if len(steps) > 0 {
-							block = append(block, errReturn)
-						}
-						if proc.ReturnType.Code == "CLASS" {
-							block = append(block, Id("resultStruct").Op(":=").Add(result))
-							block = append(block, Id("resultStruct").Dot("conn").Op("=").Id("static").Dot("conn"))
-							block = append(block, Return(Op("&").Id("resultStruct"), Nil()))
-						} else {
-							block = append(block, Return(result, Nil()))
-						}
-						static.Block(block...)
-					}
-				}
-
-				// Define instance methods.
-				// TODO: need to handle: first param named "this"
-				// Define getters.
-				// Define setters.
+			for i, line := range strings.Split(splits[1], "\n") {
+				annotated += fmt.Sprintf("%4d | %s\n", i+1, strings.Replace(line, "\t", "  ", -1))
 			}
+			log.Println(annotated)
+			log.Println(splits[0] + "while formatting source")
+		} else {
+			panic(err.Error())
+		}
+	}
+	fmt.Println(divider + "\n\n\n\n")
+}
 
-			// Enumerations.
-			for enum, values := range definition.Enumerations {
-				// Declare enumeration type.
-				file.Type().Id(enum).Int()
-
-				// Define enumeration values.
-				firstValue := values.Values[0]
-				defs := []Code{Id(firstValue.Name).Id(enum).Op("=").Iota()}
-				for _, value := range values.Values[1:] {
-					defs = append(defs, Id(enum+value.Name))
-				}
-				file.Const().Defs(defs...)
-			}
+// GenerateService generates the client for a single service.
+func GenerateService(serviceName string, definition service.Definition) *File {
+	currentService = serviceName
+
+	// Compute method tables.
+	//
+	// > Procedures names are CamelCase. Whether a procedure is a service
+	// > procedure, class method, class property, and what class (if any) it
+	// > belongs to is determined by its name:
+	// >
+	// > * `ProcedureName` - a standard procedure that is just part of a
+	//     service.
+	// > * `get_PropertyName` - a procedure that returns the value of a
+	//     property in a service.
+	// > * `set_PropertyName` - a procedure that sets the value of a property
+	//     in a service.
+	// > * `ClassName_MethodName` - a class method.
+	// > * `ClassName_static_StaticMethodName` - a static class method.
+	// > * `ClassName_get_PropertyName` - a class property getter.
+	// > * `ClassName_set_PropertyName` - a class property setter.
+	// >
+	// > Only letters and numbers are permitted in class, method and property
+	// > names. Underscores can therefore be used to split the name into its
+	// > constituent parts.
+	classes := make(map[string]bool)
+	for class := range definition.Classes {
+		classes[class] = true
+	}
+	var serviceMethods []Method
+	statics := make(map[string][]Method)
+	methods := make(map[string][]Method)
+	for _, name := range sortedProcedures(definition.Procedures) {
+		method, ok := ParseProcedure(serviceName, name, definition.Procedures[name], classes)
+		if !ok {
+			log.Printf("skipping procedure %s.%s: unrecognised name", serviceName, name)
+			continue
+		}
+		switch {
+		case method.Class == "":
+			serviceMethods = append(serviceMethods, method)
+		case method.Static:
+			statics[method.Class] = append(statics[method.Class], method)
+		default:
+			methods[method.Class] = append(methods[method.Class], method)
+		}
+	}
 
-			// Render file.
-			if *out == "" {
-				divider := strings.Repeat("-", 80)
-				fmt.Printf("Generating %s_service.go:\n", strings.ToLower(serviceName))
-				fmt.Println(divider)
-
-				var rendered bytes.Buffer
-				err = file.Render(&rendered)
-				var annotated string
-				for i, line := range strings.Split(rendered.String(), "\n") {
-					annotated += fmt.Sprintf("%4d | %s\n", i+1, strings.Replace(line, "\t", "  ", -1))
-				}
-				fmt.Println(annotated)
-
-				if err != nil {
-					// Special case: make debugging formatting errors easier.
-					msg := err.Error()
-					if strings.Contains(msg, "while formatting source:") {
-						splits := strings.Split(msg, "while formatting source:")
-
-						for i, line := range strings.Split(splits[1], "\n") {
-							annotated += fmt.Sprintf("%4d | %s\n", i+1, strings.Replace(line, "\t", "  ", -1))
-						}
-						log.Println(annotated)
-						log.Println(splits[0] + "while formatting source")
-					} else {
-						panic(err.Error())
-					}
-				}
-				fmt.Println(divider + "\n\n\n\n")
-			} else {
-				file.Save(filepath.Join(os.Getenv("GOPATH"), "src", *out, "generated_"+strings.ToLower(serviceName)+"_service.go"))
+	// New file.
+	file := NewFilePath(servicePath(serviceName))
+
+	// Service singleton. A service in its own package cannot add a method to
+	// Client, so it has a constructor instead.
+	file.Add(ParseDoc(definition.Documentation, noParams).Comment(serviceName, "provides"))
+	file.Type().Id(serviceName).Struct(
+		Id("conn").Op("*").Qual(krpcImportPath, "Conn"),
+	)
+	if servicePackages == "" {
+		file.Func().Params(Id("c").Op("*").Id("Client")).Id(serviceName).Params().Op("*").Id(serviceName).Block(
+			Return(Op("&").Id(serviceName).Values(Dict{Id("conn"): Id("c").Dot("conn")})),
+		)
+	} else {
+		file.Add(DocComment(fmt.Sprintf("New returns the %s service of the client c.", serviceName)))
+		file.Func().Id("New").Params(Id("c").Op("*").Qual(krpcImportPath, "Client")).Op("*").Id(serviceName).Block(
+			Return(Op("&").Id(serviceName).Values(Dict{Id("conn"): Id("c").Dot("Conn").Call()})),
+		)
+	}
+	for _, method := range serviceMethods {
+		generateMethod(file, method)
+	}
+
+	// Classes.
+	for _, class := range sortedClasses(definition.Classes) {
+		// Define class struct.
+		file.Add(ParseDoc(definition.Classes[class].Documentation, noParams).Comment(class, "is"))
+		file.Type().Id(class).Struct(
+			Id("conn").Op("*").Qual(krpcImportPath, "Conn"), // Should this be a reference back to the service instead?
+			Id("id").Uint64(),
+		)
+
+		// Define class codec.
+		GenerateClassCodec(file, class)
+
+		// Define static class struct and methods.
+		if len(statics[class]) > 0 {
+			file.Add(DocComment(fmt.Sprintf("%sStatic has the static methods of %s.", class, class)))
+			file.Type().Id(class + "Static").Struct(
+				Id("conn").Op("*").Qual(krpcImportPath, "Conn"),
+			)
+			file.Func().Params(
+				Id(receiverName(serviceName)).Op("*").Id(serviceName),
+			).Id(class + "Static").Params().Op("*").Id(class + "Static").Block(
+				Return(Op("&").Id(class + "Static").Values(Dict{Id("conn"): Id(receiverName(serviceName)).Dot("conn")})),
+			)
+			for _, method := range statics[class] {
+				generateMethod(file, method)
 			}
 		}
+
+		// Define instance methods, getters and setters.
+		for _, method := range methods[class] {
+			generateMethod(file, method)
+		}
+	}
+
+	// Exceptions.
+	GenerateExceptions(file, serviceName, definition.Exceptions)
+
+	// Enumerations.
+	for _, enum := range sortedEnumerations(definition.Enumerations) {
+		GenerateEnumeration(file, enum, definition.Enumerations[enum])
 	}
-}
 
-type TypeGenerator func(name string) (result Code, steps []Code)
+	return file
+}
 
-type TypeInfo struct {
-	Type, Zero Code
+// GenerateClassCodec generates the functions that encode and decode objects
+// of a class by their IDs. Object ID 0 represents null, which is decoded as
+// nil.
+func GenerateClassCodec(file *File, class string) {
+	file.Add(DocComment(fmt.Sprintf("Encode%s encodes the ID of v, or the null object ID if v is nil.", class)))
+	file.Func().Id("Encode"+class).Params(Id("v").Op("*").Id(class)).Index().Byte().Block(
+		If(Id("v").Op("==").Nil()).Block(Return(Qual(krpcImportPath, "EncodeObject").Call(Lit(0)))),
+		Return(Qual(krpcImportPath, "EncodeObject").Call(Id("v").Dot("id"))),
+	)
+	file.Add(DocComment(fmt.Sprintf("Decode%s decodes an object ID into a %s on conn, or nil for the null object ID.", class, class)))
+	file.Func().Id("Decode"+class).Params(Id("conn").Op("*").Qual(krpcImportPath, "Conn"), Id("b").Index().Byte()).Params(Op("*").Id(class), Error()).Block(
+		List(Id("id"), Err()).Op(":=").Qual(krpcImportPath, "DecodeObject").Call(Id("b")),
+		If(Err().Op("!=").Nil()).Block(Return(Nil(), Err())),
+		If(Id("id").Op("==").Lit(0)).Block(Return(Nil(), Nil())),
+		Return(Op("&").Id(class).Values(Dict{
+			Id("conn"): Id("conn"),
+			Id("id"):   Id("id"),
+		}), Nil()),
+	)
+}
 
-	Marshal   TypeGenerator
-	Unmarshal TypeGenerator
+// runtimeExceptions are the exception types defined by the krpc package,
+// which services may also declare.
+var runtimeExceptions = map[string]bool{
+	"InvalidOperationException":   true,
+	"ArgumentException":           true,
+	"ArgumentNullException":       true,
+	"ArgumentOutOfRangeException": true,
 }
 
-func GenerateType(t service.Type) TypeInfo {
-	// Generate parameter type, zero, and marshalling code.
-	switch t.Code {
-	case "SINT32":
-		return TypeInfo{
-			Type:      Int32(),
-			Zero:      Lit(0),
-			Marshal:   MarshalBuffer("EncodeZigzag32"),
-			Unmarshal: UnmarshalBuffer("DecodeZigzag32"),
+// GenerateExceptions generates an error type for each exception declared by a
+// service, and registers them so that the connection returns them.
+func GenerateExceptions(file *File, serviceName string, exceptions map[string]service.Exception) {
+	var names []string
+	for name := range exceptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var registrations []Code
+	for _, name := range names {
+		if !runtimeExceptions[name] {
+			doc := ParseDoc(exceptions[name].Documentation, noParams)
+			if doc.Summary == "" {
+				doc.Summary = fmt.Sprintf("%s is an exception thrown by the %s service.", name, serviceName)
+			}
+			file.Add(doc.Comment(name, "is"))
+			file.Type().Id(name).Struct(Qual(krpcImportPath, "Exception"))
 		}
-	case "BOOL":
-		return TypeInfo{
-			Type: Bool(),
-			Zero: Lit(false),
-			Marshal: func(paramName string) (Code, []Code) {
-				return Qual(protoImportPath, "EncodeVarint").Call(Id(paramName)), nil
-			},
-			Unmarshal: func(byteSlice string) (Code, []Code) {
-				decoded := byteSlice + "Decoded"
-				steps := []Code{List(Id(decoded), Err()).Op(":=").Qual(protoImportPath, "DecodeVarint").Call(Id(byteSlice))}
-				return Id(decoded), steps
-			},
+		exception := Id(name)
+		if runtimeExceptions[name] {
+			exception = Qual(krpcImportPath, name)
 		}
-	case "STRING":
-		return TypeInfo{
-			Type:      String(),
-			Zero:      Lit(""),
-			Marshal:   MarshalBuffer("EncodeStringBytes"),
-			Unmarshal: UnmarshalBuffer("DecodeStringBytes"),
+		registrations = append(registrations, Qual(krpcImportPath, "RegisterException").Call(
+			Lit(serviceName),
+			Lit(name),
+			Func().Params(Id("e").Qual(krpcImportPath, "Exception")).Error().Block(
+				Return(Op("&").Add(exception).Values(Dict{Id("Exception"): Id("e")})),
+			),
+		))
+	}
+	if len(registrations) > 0 {
+		file.Func().Id("init").Params().Block(registrations...)
+	}
+}
+
+// Method describes the Go method generated for a procedure.
+type Method struct {
+	Service   string
+	Procedure string
+	Proc      service.Procedure
+
+	// Class is the class the procedure belongs to, or empty for service
+	// procedures.
+	Class string
+	// Static is true for static class methods, which are defined on the
+	// class's Static struct.
+	Static bool
+	// This is true when the procedure's first parameter is the object the
+	// method is called on.
+	This bool
+
+	// Property is "get" or "set" for property accessors.
+	Property string
+
+	// Name is the Go name of the method.
+	Name string
+}
+
+// ParseProcedure determines the kind of a procedure from its name.
+func ParseProcedure(serviceName, name string, proc service.Procedure, classes map[string]bool) (Method, bool) {
+	method := Method{
+		Service:   serviceName,
+		Procedure: name,
+		Proc:      proc,
+	}
+
+	splits := strings.Split(name, "_")
+	switch len(splits) {
+	case 1:
+		// ProcedureName
+		method.Name = name
+		return method, true
+	case 2:
+		switch splits[0] {
+		case "get":
+			// get_PropertyName
+			method.Property = "get"
+			method.Name = splits[1]
+			return method, true
+		case "set":
+			// set_PropertyName
+			method.Property = "set"
+			method.Name = "Set" + splits[1]
+			return method, true
 		}
-	case "FLOAT":
-		return TypeInfo{
-			Type:      Float32(),
-			Zero:      Lit(0.0),
-			Marshal:   MarshalBuffer("EncodeFixed32"),
-			Unmarshal: UnmarshalBuffer("DecodeFixed32"),
+		if !classes[splits[0]] {
+			return method, false
 		}
-	case "DOUBLE":
-		return TypeInfo{
-			Type:      Float64(),
-			Zero:      Lit(0.0),
-			Marshal:   MarshalBuffer("EncodeFixed64"),
-			Unmarshal: UnmarshalBuffer("DecodeFixed64"),
+		// ClassName_MethodName
+		method.Class = splits[0]
+		method.This = true
+		method.Name = splits[1]
+		return method, true
+	case 3:
+		if !classes[splits[0]] {
+			return method, false
 		}
-	case "LIST":
-		if len(t.Types) != 1 {
-			panic(t)
+		method.Class = splits[0]
+		switch splits[1] {
+		case "static":
+			// ClassName_static_StaticMethodName
+			method.Static = true
+			method.Name = splits[2]
+		case "get":
+			// ClassName_get_PropertyName
+			method.This = true
+			method.Property = "get"
+			method.Name = splits[2]
+		case "set":
+			// ClassName_set_PropertyName
+			method.This = true
+			method.Property = "set"
+			method.Name = "Set" + splits[2]
+		default:
+			return method, false
 		}
-		return TypeInfo{
-			Type: Id("TODO"),
-			Zero: Id("TODO").Values(),
-			Marshal: func(_ string) (Code, []Code) {
-				return Id("TODO"), nil
-			},
-			Unmarshal: func(byteSlice string) (Code, []Code) {
-				return Id("TODO"), nil
-			},
+		return method, true
+	}
+	return method, false
+}
+
+// Receiver returns the receiver variable name and type name of the method.
+func (m Method) Receiver() (string, string) {
+	switch {
+	case m.Class == "":
+		return receiverName(m.Service), m.Service
+	case m.Static:
+		return "static", m.Class + "Static"
+	default:
+		return receiverName(m.Class), m.Class
+	}
+}
+
+// GenerateMethod generates a method that calls the procedure, a method with a
+// "Context" suffix that calls it with a context, and a method with a "Call"
+// suffix that returns the procedure call without making it, for use with
+// streams. Nothing is generated if the procedure uses an unsupported
+// type.
+func GenerateMethod(file *File, m Method) error {
+	recv, recvType := m.Receiver()
+
+	// Take idiomatic parameters.
+	params := m.Proc.Parameters
+	var args []Code
+	if m.This {
+		args = append(args, Op("&").Qual(pbImportPath, "Argument").Values(Dict{
+			Id("Position"): Lit(0),
+			Id("Value"):    Qual(krpcImportPath, "EncodeObject").Call(Id(recv).Dot("id")),
+		}))
+		params = params[1:]
+	}
+	var paramDecls []Code
+	var paramNames []Code
+	for i, param := range params {
+		generate := GenerateType
+		if param.Nullable {
+			generate = GenerateNullableType
 		}
-	case "TUPLE":
-		// Since Go has neither generics nor first-class support for tuples, we
-		// must generate tuple structs for each type of tuple. As you can imagine,
-		// this is very annoying. For pragmatism, we hard-code a set of 4 tuple
-		// structs that we use in generation, since it appears these are the only
-		// 4 types of tuples that ever occur:
-		//
-		//   - (double, double): RectTransform_get_Position
-		//   - (double, double, double): many
-		//   - (double, double, double, double): Text_set_Rotation
-		//   - ((double, double, double), (double, double, double)): Part_BoundingBox
-		var tupleStruct string
-
-		if len(t.Types) == 2 {
-			if t.Types[0].Code == "TUPLE" {
-				tupleStruct = "BoundingBox"
-			}
-			tupleStruct = "Point"
-		} else if len(t.Types) == 3 {
-			tupleStruct = "Vector"
-		} else if len(t.Types) == 4 {
-			tupleStruct = "Quaternion"
-		} else {
-			panic(t)
+		info, err := generate(param.Type)
+		if err != nil {
+			return fmt.Errorf("parameter %s: %v", param.Name, err)
 		}
+		name := paramName(param.Name, recv)
 
-		return TypeInfo{
-			Type: Id(tupleStruct),
-			Zero: Id(tupleStruct).Values(),
-			Marshal: func(_ string) (Code, []Code) {
-				return Id("TODO"), nil
-			},
-			Unmarshal: func(byteSlice string) (Code, []Code) {
-				return Id("TODO"), nil
-			},
+		paramDecls = append(paramDecls, Id(name).Add(info.Type))
+		paramNames = append(paramNames, Id(name))
+		position := i
+		if m.This {
+			position++
 		}
-	case "ENUMERATION":
-		return TypeInfo{
-			Type: Id(t.Name),
-			Zero: Lit(-1),
-			Marshal: func(paramName string) (Code, []Code) {
-				return Qual(protoImportPath, "EncodeVarint").Call(Id(paramName)), nil
-			},
-			Unmarshal: func(byteSlice string) (Code, []Code) {
-				decoded := byteSlice + "Decoded"
-				steps := []Code{List(Id(decoded), Err()).Op(":=").Qual(protoImportPath, "DecodeVarint").Call(Id(byteSlice))}
-				return Id(t.Name).Call(Id(decoded)), steps
-			},
+		args = append(args, Op("&").Qual(pbImportPath, "Argument").Values(Dict{
+			Id("Position"): Lit(position),
+			Id("Value"):    info.Marshal(Id(name)),
+		}))
+	}
+
+	// Generate return type.
+	var returns []Code
+	var zeros []Code
+	var unmarshaller TypeGenerator
+	if m.Proc.ReturnType.Code != "" {
+		generate := GenerateType
+		if m.Proc.ReturnIsNullable {
+			generate = GenerateNullableType
 		}
-	case "CLASS":
-		return TypeInfo{
-			Type: Op("*").Id(t.Name),
-			Zero: Nil(),
-			Marshal: func(paramName string) (Code, []Code) {
-				return Qual(protoImportPath, "EncodeVarint").Call(Id(paramName)), nil
-			},
-			Unmarshal: func(byteSlice string) (Code, []Code) {
-				decoded := byteSlice + "Decoded"
-				steps := []Code{List(Id(decoded), Err()).Op(":=").Qual(protoImportPath, "DecodeVarint").Call(Id(byteSlice))}
-				return Id(t.Name).Values(Dict{Id("id"): Id(decoded)}), steps
-			},
+		info, err := generate(m.Proc.ReturnType)
+		if err != nil {
+			return fmt.Errorf("return type: %v", err)
 		}
+		returns = append(returns, info.Type)
+		zeros = append(zeros, info.Zero)
+		unmarshaller = info.Unmarshal
 	}
-	panic(t.Code)
+	returns = append(returns, Error())
+
+	// Generate documentation. Parameter references use the Go names of the
+	// parameters.
+	doc := ParseDoc(m.Proc.Documentation, func(name string) string {
+		return paramName(name, recv)
+	})
+	verb := map[string]string{"get": "returns", "set": "sets"}[m.Property]
+
+	// Generate call constructor.
+	file.Add(DocComment(fmt.Sprintf("%sCall returns the procedure call for %s, for use with streams and events.", m.Name, m.Name)))
+	file.Func().Params(
+		Id(recv).Op("*").Id(recvType),
+	).Id(m.Name+"Call").Params(paramDecls...).Op("*").Qual(pbImportPath, "ProcedureCall").Block(
+		Return(Op("&").Qual(pbImportPath, "ProcedureCall").Values(Dict{
+			Id("Service"):   Lit(m.Service),
+			Id("Procedure"): Lit(m.Procedure),
+			Id("Arguments"): Index().Op("*").Qual(pbImportPath, "Argument").Values(args...),
+		})),
+	)
+
+	errReturn := If(Err().Op("!=").Nil()).Block(Return(append(zeros, Err())...))
+
+	// Generate method body.
+	var block []Code
+	call := Id(recv).Dot("conn").Dot("Invoke").Call(Id("ctx"), Id(recv).Dot(m.Name+"Call").Call(paramNames...))
+	if unmarshaller == nil {
+		block = append(block,
+			List(Id("_"), Err()).Op(":=").Add(call),
+			Return(Err()),
+		)
+	} else {
+		// Make request.
+		block = append(block, List(Id("resultBytes"), Err()).Op(":=").Add(call))
+		block = append(block, errReturn)
+		// Unmarshal result bytes.
+		if containsClass(m.Proc.ReturnType) {
+			block = append(block, Id("conn").Op(":=").Id(recv).Dot("conn"))
+		}
+		result, steps := unmarshaller("resultBytes")
+		block = append(block, steps...)
+		if len(steps) > 0 {
+			block = append(block, errReturn)
+		}
+		block = append(block, Return(result, Nil()))
+	}
+
+	file.Add(doc.Comment(m.Name, verb))
+	file.Func().Params(
+		Id(recv).Op("*").Id(recvType),
+	).Id(m.Name).Params(paramDecls...).Params(returns...).Block(
+		Return(Id(recv).Dot(m.Name + "Context").Call(append([]Code{Qual("context", "Background").Call()}, paramNames...)...)),
+	)
+
+	// Generate context method.
+	ctxParamDecls := append([]Code{Id("ctx").Qual("context", "Context")}, paramDecls...)
+	file.Add(DocComment(fmt.Sprintf("%sContext is like %s, but gives up waiting for the server when ctx is done.", m.Name, m.Name)))
+	file.Func().Params(
+		Id(recv).Op("*").Id(recvType),
+	).Id(m.Name + "Context").Params(ctxParamDecls...).Params(returns...).Block(block...)
+	return nil
 }
 
-func MarshalBuffer(method string) TypeGenerator {
-	return func(paramName string) (Code, []Code) {
-		buf := paramName + "Buffer"
-		steps := []Code{
-			Id(buf).Op(":=").Qual(protoImportPath, "Buffer").Values(),
-			Err().Op(":=").Add(Id(buf).Dot(method).Call(Id(paramName))),
-		}
-		result := Id(buf).Dot("Bytes").Call()
-		return result, steps
+// generateMethod generates a method, logging and skipping procedures that
+// cannot be generated.
+func generateMethod(file *File, m Method) {
+	if err := GenerateMethod(file, m); err != nil {
+		log.Printf("skipping procedure %s.%s: %v", m.Service, m.Procedure, err)
 	}
 }
 
-func UnmarshalBuffer(method string) TypeGenerator {
-	return func(byteSlice string) (Code, []Code) {
-		parsed := byteSlice + "Parsed"
-		steps := []Code{
-			List(Id(parsed), Err()).Op(":=").Qual(protoImportPath, "NewBuffer").Call(Id(byteSlice)).Dot(method).Call(),
+// noParams converts parameter references in documentation that has no
+// parameters.
+func noParams(name string) string {
+	return name
+}
+
+// receiverName returns the conventional receiver name for a type.
+func receiverName(typeName string) string {
+	return strings.ToLower(typeName[:1])
+}
+
+// reserved are identifiers that generated parameters must not shadow.
+var reserved = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true, "continue": true,
+	"default": true, "defer": true, "else": true, "fallthrough": true,
+	"for": true, "func": true, "go": true, "goto": true, "if": true,
+	"import": true, "interface": true, "map": true, "package": true,
+	"range": true, "return": true, "select": true, "struct": true,
+	"switch": true, "type": true, "var": true,
+
+	"conn": true, "context": true, "ctx": true, "err": true, "pb": true,
+	"resultBytes": true, "static": true,
+}
+
+// paramName converts a snake_case parameter name into a camelCase Go
+// identifier that does not collide with keywords, generated locals or the
+// method receiver.
+func paramName(name, recv string) string {
+	var converted string
+	for i, part := range strings.Split(name, "_") {
+		if part == "" {
+			continue
+		}
+		if i == 0 {
+			converted += part
+		} else {
+			converted += strings.ToUpper(part[:1]) + part[1:]
 		}
-		result := Id(parsed)
-		return result, steps
 	}
+	if reserved[converted] || converted == recv {
+		converted += "Arg"
+	}
+	return converted
+}
+
+func sortedServices(services service.Services) []string {
+	var names []string
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedPaths(files map[string]*File) []string {
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func sortedProcedures(procs map[string]service.Procedure) []string {
+	var names []string
+	for name := range procs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedEnumerations(enums map[string]service.Enumeration) []string {
+	var names []string
+	for name := range enums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedClasses(classes map[string]service.Class) []string {
+	var names []string
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ilikebits/jeb/cmd/krpc-gen/service"
+)
+
+// generatedServices returns services with a class, its methods and
+// properties, an enumeration, an exception and tuples, of which one is
+// shared between the services.
+func generatedServices() service.Services {
+	services := crossServiceTuple()
+	vessel := service.Type{Code: "CLASS", Service: "SpaceCenter", Name: "Vessel"}
+	spaceCenter := services["SpaceCenter"]
+	spaceCenter.Classes = map[string]service.Class{"Vessel": {}}
+	spaceCenter.Exceptions = map[string]service.Exception{"TooFast": {}}
+	for name, proc := range map[string]service.Procedure{
+		"get_ActiveVessel": {ID: 2, ReturnType: vessel, ReturnIsNullable: true},
+		"Vessel_get_Name": {ID: 3, Parameters: []service.Parameter{
+			{Name: "this", Type: vessel},
+		}, ReturnType: service.Type{Code: "STRING"}},
+		"Vessel_set_Name": {ID: 4, Parameters: []service.Parameter{
+			{Name: "this", Type: vessel},
+			{Name: "value", Type: service.Type{Code: "STRING"}},
+		}},
+		"Vessel_Position": {ID: 5, Parameters: []service.Parameter{
+			{Name: "this", Type: vessel},
+			{Name: "scale", Type: service.Type{Code: "DOUBLE"}},
+		}, ReturnType: service.Type{Code: "TUPLE", Types: []service.Type{
+			{Code: "BOOL"}, {Code: "STRING"},
+		}}},
+		"Vessel_static_Count": {ID: 6, ReturnType: service.Type{Code: "SINT32"}},
+		"get_Crew": {ID: 7, ReturnType: service.Type{Code: "DICTIONARY", Types: []service.Type{
+			{Code: "STRING"}, {Code: "LIST", Types: []service.Type{vessel}},
+		}}},
+	} {
+		spaceCenter.Procedures[name] = proc
+	}
+	services["SpaceCenter"] = spaceCenter
+	return services
+}
+
+func TestGenerateTypeChecks(t *testing.T) {
+	for _, packages := range []string{"", krpcImportPath} {
+		tuples, services := generateAll(packages, generatedServices())
+
+		// Each generated file is parsed as if saved in its package's
+		// directory, so that imports are resolved from there.
+		generated := make(map[string]map[string]string)
+		add := func(path, name, src string) {
+			if generated[path] == nil {
+				generated[path] = make(map[string]string)
+			}
+			generated[path][name] = src
+		}
+		for path, src := range tuples {
+			add(path, "generated_tuples.go", src)
+		}
+		for name, src := range services {
+			path := krpcImportPath
+			if packages != "" {
+				path = packages + "/" + strings.ToLower(name)
+			}
+			add(path, "generated_"+strings.ToLower(name)+"_service.go", src)
+		}
+
+		c := newTypeChecker(t, generated)
+		for path := range generated {
+			if _, err := c.Import(path); err != nil {
+				t.Errorf("packages %q: %s: %v", packages, path, err)
+			}
+		}
+	}
+}
+
+// typeChecker type-checks generated packages, with the krpc package's own
+// files added to any code generated into it, and imports other packages from
+// source.
+type typeChecker struct {
+	fset      *token.FileSet
+	krpcDir   string
+	generated map[string]map[string]string
+	checked   map[string]*types.Package
+	source    types.ImporterFrom
+}
+
+func newTypeChecker(t *testing.T, generated map[string]map[string]string) *typeChecker {
+	krpc, err := build.Import(krpcImportPath, "", build.FindOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &typeChecker{
+		fset:      token.NewFileSet(),
+		krpcDir:   krpc.Dir,
+		generated: generated,
+		checked:   make(map[string]*types.Package),
+		source:    importer.For("source", nil).(types.ImporterFrom),
+	}
+}
+
+func (c *typeChecker) Import(path string) (*types.Package, error) {
+	return c.ImportFrom(path, c.krpcDir, 0)
+}
+
+func (c *typeChecker) ImportFrom(path, dir string, mode types.ImportMode) (*types.Package, error) {
+	if pkg, ok := c.checked[path]; ok {
+		return pkg, nil
+	}
+	sources, ok := c.generated[path]
+	if !ok {
+		return c.source.ImportFrom(path, dir, mode)
+	}
+
+	pkgDir := filepath.Join(c.krpcDir, strings.TrimPrefix(path, krpcImportPath))
+	var files []*ast.File
+	if path == krpcImportPath {
+		krpc, err := build.ImportDir(c.krpcDir, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range krpc.GoFiles {
+			if _, ok := sources[name]; ok {
+				continue
+			}
+			f, err := parser.ParseFile(c.fset, filepath.Join(c.krpcDir, name), nil, 0)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+		}
+	}
+	for name, src := range sources {
+		f, err := parser.ParseFile(c.fset, filepath.Join(pkgDir, name), src, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	conf := types.Config{Importer: c}
+	pkg, err := conf.Check(path, c.fset, files, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.checked[path] = pkg
+	return pkg, nil
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// FromPB converts services returned by KRPC.GetServices to service
+// definitions. Services and procedures are numbered from 1 in the order the
+// server lists them, as in the JSON definitions.
+func FromPB(services *pb.Services) Services {
+	defs := make(Services)
+	for i, s := range services.GetServices() {
+		def := Definition{
+			ID:            i + 1,
+			Documentation: s.GetDocumentation(),
+			Procedures:    make(map[string]Procedure),
+			Classes:       make(map[string]Class),
+			Enumerations:  make(map[string]Enumeration),
+			Exceptions:    make(map[string]Exception),
+		}
+		for j, p := range s.GetProcedures() {
+			proc := Procedure{
+				ID:               j + 1,
+				ReturnIsNullable: p.GetReturnIsNullable(),
+				Documentation:    p.GetDocumentation(),
+			}
+			for _, param := range p.GetParameters() {
+				proc.Parameters = append(proc.Parameters, Parameter{
+					Name:     param.GetName(),
+					Type:     typeFromPB(param.GetType()),
+					Nullable: param.GetNullable(),
+				})
+			}
+			if p.GetReturnType().GetCode() != pb.Type_NONE {
+				proc.ReturnType = typeFromPB(p.GetReturnType())
+			}
+			def.Procedures[p.GetName()] = proc
+		}
+		for _, c := range s.GetClasses() {
+			def.Classes[c.GetName()] = Class{Documentation: c.GetDocumentation()}
+		}
+		for _, e := range s.GetEnumerations() {
+			enum := Enumeration{Documentation: e.GetDocumentation()}
+			for _, v := range e.GetValues() {
+				enum.Values = append(enum.Values, Value{
+					Name:          v.GetName(),
+					Value:         int(v.GetValue()),
+					Documentation: v.GetDocumentation(),
+				})
+			}
+			def.Enumerations[e.GetName()] = enum
+		}
+		for _, e := range s.GetExceptions() {
+			def.Exceptions[e.GetName()] = Exception{Documentation: e.GetDocumentation()}
+		}
+		defs[s.GetName()] = def
+	}
+	return defs
+}
+
+func typeFromPB(t *pb.Type) Type {
+	typ := Type{
+		Code:    t.GetCode().String(),
+		Service: t.GetService(),
+		Name:    t.GetName(),
+	}
+	for _, sub := range t.GetTypes() {
+		typ.Types = append(typ.Types, typeFromPB(sub))
+	}
+	return typ
+}
@@ -0,0 +1,75 @@
+package service_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ilikebits/jeb/cmd/krpc-gen/service"
+	"github.com/ilikebits/jeb/krpc"
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// testService is a service with a procedure, class and enumeration.
+var testService = &pb.Service{
+	Name:          "SpaceCenter",
+	Documentation: "<doc><summary>Space center.</summary></doc>",
+	Procedures: []*pb.Procedure{
+		{
+			Name: "WarpTo",
+			Parameters: []*pb.Parameter{
+				{Name: "ut", Type: &pb.Type{Code: pb.Type_DOUBLE}},
+				{Name: "max_rails_rate", Type: &pb.Type{Code: pb.Type_FLOAT}, DefaultValue: krpc.EncodeFloat32(100000)},
+			},
+		},
+		{
+			Name:             "get_ActiveVessel",
+			ReturnType:       &pb.Type{Code: pb.Type_CLASS, Service: "SpaceCenter", Name: "Vessel"},
+			ReturnIsNullable: true,
+		},
+		{
+			Name: "Vessel_get_Situation",
+			Parameters: []*pb.Parameter{
+				{Name: "this", Type: &pb.Type{Code: pb.Type_CLASS, Service: "SpaceCenter", Name: "Vessel"}},
+			},
+			ReturnType: &pb.Type{Code: pb.Type_ENUMERATION, Service: "SpaceCenter", Name: "VesselSituation"},
+		},
+	},
+	Classes:      []*pb.Class{{Name: "Vessel"}},
+	Enumerations: []*pb.Enumeration{{Name: "VesselSituation", Values: []*pb.EnumerationValue{{Name: "Landed", Value: 1}}}},
+}
+
+func TestFromPB(t *testing.T) {
+	services := service.FromPB(&pb.Services{Services: []*pb.Service{testService}})
+	want := service.Services{
+		"SpaceCenter": {
+			ID:            1,
+			Documentation: "<doc><summary>Space center.</summary></doc>",
+			Procedures: map[string]service.Procedure{
+				"WarpTo": {ID: 1, Parameters: []service.Parameter{
+					{Name: "ut", Type: service.Type{Code: "DOUBLE"}},
+					{Name: "max_rails_rate", Type: service.Type{Code: "FLOAT"}},
+				}},
+				"get_ActiveVessel": {
+					ID:               2,
+					ReturnType:       service.Type{Code: "CLASS", Service: "SpaceCenter", Name: "Vessel"},
+					ReturnIsNullable: true,
+				},
+				"Vessel_get_Situation": {
+					ID: 3,
+					Parameters: []service.Parameter{
+						{Name: "this", Type: service.Type{Code: "CLASS", Service: "SpaceCenter", Name: "Vessel"}},
+					},
+					ReturnType: service.Type{Code: "ENUMERATION", Service: "SpaceCenter", Name: "VesselSituation"},
+				},
+			},
+			Classes: map[string]service.Class{"Vessel": {}},
+			Enumerations: map[string]service.Enumeration{
+				"VesselSituation": {Values: []service.Value{{Name: "Landed", Value: 1}}},
+			},
+			Exceptions: map[string]service.Exception{},
+		},
+	}
+	if !reflect.DeepEqual(services, want) {
+		t.Errorf("got %+v, want %+v", services, want)
+	}
+}
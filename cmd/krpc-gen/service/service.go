@@ -8,20 +8,21 @@ type Definition struct {
 	Procedures    map[string]Procedure
 	Classes       map[string]Class
 	Enumerations  map[string]Enumeration
-	Exceptions    map[string]struct{}
+	Exceptions    map[string]Exception
 }
 
 type Procedure struct {
 	ID               int
 	Parameters       []Parameter
 	ReturnType       Type `json:"return_type"`
-	ReturnIsNullable bool
+	ReturnIsNullable bool `json:"return_is_nullable"`
 	Documentation    string
 }
 
 type Parameter struct {
-	Name string
-	Type Type `json:"type"`
+	Name     string
+	Type     Type `json:"type"`
+	Nullable bool
 }
 
 type Type struct {
@@ -45,3 +46,7 @@ type Value struct {
 	Value         int
 	Documentation string
 }
+
+type Exception struct {
+	Documentation string
+}
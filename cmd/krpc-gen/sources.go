@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ilikebits/jeb/cmd/krpc-gen/service"
+	"github.com/ilikebits/jeb/krpc"
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// serverTimeout is how long to wait for a server to list its services.
+const serverTimeout = 30 * time.Second
+
+// ReadDir reads every JSON service definition file in dir.
+func ReadDir(dir string) (service.Services, error) {
+	ls, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(service.Services)
+	for _, file := range ls {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var defs service.Services
+		err = json.Unmarshal(contents, &defs)
+		if err != nil {
+			return nil, errors.Wrap(err, file.Name())
+		}
+		for name, def := range defs {
+			services[name] = def
+		}
+	}
+	return services, nil
+}
+
+// ReadServer fetches the services of the kRPC server at addr, returning them
+// both as a message and as service definitions.
+func ReadServer(addr string) (*pb.Services, service.Services, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimeout)
+	defer cancel()
+
+	c, err := krpc.DialContext(ctx, addr,
+		krpc.WithClientName("krpc-gen"),
+		krpc.WithStream(false),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+
+	msg, err := c.KRPC.GetServicesContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &msg, fromPB(&msg), nil
+}
+
+// ReadPB reads an encoded Services message, as returned by KRPC.GetServices.
+func ReadPB(name string) (service.Services, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var msg pb.Services
+	err = krpc.DecodeMessage(contents, &msg)
+	if err != nil {
+		return nil, errors.Wrap(err, name)
+	}
+	return fromPB(&msg), nil
+}
+
+// WritePB writes an encoded Services message that can be read with ReadPB.
+func WritePB(name string, msg *pb.Services) error {
+	contents, err := krpc.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, contents, 0644)
+}
+
+// fromPB converts services to service definitions, leaving out the KRPC
+// service, which the krpc package implements by hand.
+func fromPB(msg *pb.Services) service.Services {
+	services := service.FromPB(msg)
+	delete(services, "KRPC")
+	return services
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ilikebits/jeb/cmd/krpc-gen/service"
+	"github.com/ilikebits/jeb/krpc/krpctest"
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// testService is a service with a procedure and a class.
+var testService = &pb.Service{
+	Name:          "SpaceCenter",
+	Documentation: "<doc><summary>Space center.</summary></doc>",
+	Procedures: []*pb.Procedure{
+		{
+			Name:             "get_ActiveVessel",
+			ReturnType:       &pb.Type{Code: pb.Type_CLASS, Service: "SpaceCenter", Name: "Vessel"},
+			ReturnIsNullable: true,
+		},
+	},
+	Classes: []*pb.Class{{Name: "Vessel"}},
+}
+
+func TestReadServer(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	srv.AddService(testService)
+
+	msg, services, err := ReadServer(srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := services["KRPC"]; ok {
+		t.Errorf("KRPC service was not left out")
+	}
+	// The server lists the KRPC service first.
+	want := service.FromPB(&pb.Services{Services: []*pb.Service{testService}})["SpaceCenter"]
+	want.ID = 2
+	if len(services) != 1 || !reflect.DeepEqual(services["SpaceCenter"], want) {
+		t.Errorf("got services %+v, want SpaceCenter %+v", services, want)
+	}
+
+	// The saved message reads back as the same services.
+	dir, err := ioutil.TempDir("", "krpc-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "services.pb")
+	if err := WritePB(name, msg); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadPB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, services) {
+		t.Errorf("read %+v, want %+v", read, services)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	. "github.com/dave/jennifer/jen"
+	"github.com/ilikebits/jeb/cmd/krpc-gen/service"
+)
+
+// Since Go has neither generics nor first-class support for tuples, we must
+// generate tuple structs for each type of tuple. The common tuples map to the
+// structs in the krpc package:
+//
+//   - (double, double): RectTransform_get_Position
+//   - (double, double, double): many
+//   - (double, double, double, double): Text_set_Rotation
+//   - ((double, double, double), (double, double, double)): Part_BoundingBox
+//
+// Other tuples get a struct named after their element types, such as
+// TupleBoolString for (bool, string), unless the -tuples mapping file names
+// them. Mapped names take precedence over the canonical structs.
+var canonicalTuples = map[string]string{
+	"(DOUBLE, DOUBLE)":                                     "Point",
+	"(DOUBLE, DOUBLE, DOUBLE)":                             "Vector",
+	"(DOUBLE, DOUBLE, DOUBLE, DOUBLE)":                     "Quaternion",
+	"((DOUBLE, DOUBLE, DOUBLE), (DOUBLE, DOUBLE, DOUBLE))": "BoundingBox",
+}
+
+// tupleMappings maps tuple signatures to struct names, read from the -tuples
+// flag.
+var tupleMappings = make(map[string]string)
+
+// tupleStructs are the tuple structs to generate, by the service whose
+// package they are generated in and name.
+var tupleStructs = make(map[tupleKey]service.Type)
+
+// tupleKey identifies a tuple struct. Service is empty for structs generated in
+// the krpc package.
+type tupleKey struct {
+	Service, Name string
+}
+
+// path returns the import path of the package the struct is generated in.
+func (k tupleKey) path() string {
+	if k.Service == "" {
+		return krpcImportPath
+	}
+	return servicePath(k.Service)
+}
+
+// currentService is the service being generated, whose package gets the tuple
+// structs of service types that its procedures use.
+var currentService string
+
+// GenerateTupleType generates the type information for a tuple, registering
+// its struct for generation if it has no canonical mapping.
+func GenerateTupleType(t service.Type) (TypeInfo, error) {
+	if len(t.Types) == 0 {
+		return TypeInfo{}, fmt.Errorf("empty tuple")
+	}
+	signature := typeSignature(t)
+	name, ok := tupleMappings[signature]
+	if !ok {
+		if canonical, ok := canonicalTuples[signature]; ok {
+			return TypeInfo{
+				Type:      Qual(krpcImportPath, canonical),
+				Zero:      Qual(krpcImportPath, canonical).Values(),
+				Marshal:   MarshalCodec("Encode" + canonical),
+				Unmarshal: UnmarshalCodec("Decode" + canonical),
+			}, nil
+		}
+		name = "Tuple" + elementNames(t.Types)
+	}
+
+	// Check that the elements can be generated before registering the struct.
+	for _, elem := range t.Types {
+		_, err := GenerateType(elem)
+		if err != nil {
+			return TypeInfo{}, fmt.Errorf("tuple %s: %v", signature, err)
+		}
+	}
+	key := tupleKey{Service: tupleService(t), Name: name}
+	if existing, ok := tupleStructs[key]; ok && typeSignature(existing) != signature {
+		return TypeInfo{}, fmt.Errorf("tuple %s: struct %s is already used for %s", signature, name, typeSignature(existing))
+	}
+	tupleStructs[key] = t
+
+	path := key.path()
+	unmarshal := UnmarshalQual(path, "Decode"+name)
+	if containsClass(t) {
+		// Decoded objects need a connection.
+		unmarshal = func(byteSlice string) (Code, []Code) {
+			decoded := byteSlice + "Decoded"
+			steps := []Code{
+				List(Id(decoded), Err()).Op(":=").Qual(path, "Decode"+name).Call(Id("conn"), Id(byteSlice)),
+			}
+			return Id(decoded), steps
+		}
+	}
+	return TypeInfo{
+		Type:      Qual(path, name),
+		Zero:      Qual(path, name).Values(),
+		Marshal:   MarshalQual(path, "Encode"+name),
+		Unmarshal: unmarshal,
+	}, nil
+}
+
+// tupleService returns the service in whose package a tuple struct is
+// generated, or an empty string for the krpc package. Tuples of service
+// classes or enumerations are generated in the package of the service being
+// generated, which already imports the packages of their services, so that
+// neither the krpc package nor another service package has to import it.
+// Such a tuple used by several services gets a struct in each of their
+// packages.
+func tupleService(t service.Type) string {
+	if servicePackages == "" || !containsServiceType(t) {
+		return ""
+	}
+	return currentService
+}
+
+// containsServiceType reports whether t is or contains a service class or
+// enumeration.
+func containsServiceType(t service.Type) bool {
+	if t.Code == "CLASS" || t.Code == "ENUMERATION" {
+		return true
+	}
+	for _, elem := range t.Types {
+		if containsServiceType(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// elementNames derives a name for a tuple from the names of its element
+// types.
+func elementNames(types []service.Type) string {
+	var name string
+	for _, t := range types {
+		name += elementName(t)
+	}
+	return name
+}
+
+func elementName(t service.Type) string {
+	switch t.Code {
+	case "DOUBLE":
+		return "Float64"
+	case "FLOAT":
+		return "Float32"
+	case "SINT32":
+		return "Int32"
+	case "SINT64":
+		return "Int64"
+	case "UINT32":
+		return "Uint32"
+	case "UINT64":
+		return "Uint64"
+	case "BOOL":
+		return "Bool"
+	case "STRING":
+		return "String"
+	case "BYTES":
+		return "Bytes"
+	case "CLASS", "ENUMERATION":
+		return t.Name
+	case "TUPLE":
+		signature := typeSignature(t)
+		if name, ok := tupleMappings[signature]; ok {
+			return name
+		}
+		if name, ok := canonicalTuples[signature]; ok {
+			return name
+		}
+		return "Tuple" + elementNames(t.Types)
+	case "LIST":
+		return "List" + elementNames(t.Types)
+	case "SET":
+		return "Set" + elementNames(t.Types)
+	case "DICTIONARY":
+		return "Map" + elementNames(t.Types)
+	}
+	return t.Code
+}
+
+// GenerateTuples generates the structs and codecs of the tuples registered
+// while generating services, returning a file for each package that has
+// tuples, by import path.
+func GenerateTuples() map[string]*File {
+	files := make(map[string]*File)
+
+	var keys []tupleKey
+	for key := range tupleStructs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Service != keys[j].Service {
+			return keys[i].Service < keys[j].Service
+		}
+		return keys[i].Name < keys[j].Name
+	})
+
+	for _, key := range keys {
+		t, name := tupleStructs[key], key.Name
+		path := key.path()
+		// Nested tuples are generated in the same package.
+		currentService = key.Service
+		file, ok := files[path]
+		if !ok {
+			file = NewFilePath(path)
+			files[path] = file
+		}
+
+		// Elements were checked when the tuple was registered.
+		var infos []TypeInfo
+		for _, elem := range t.Types {
+			info, _ := GenerateType(elem)
+			infos = append(infos, info)
+		}
+
+		// Define struct. Fields are numbered from 1, like the items of the
+		// server's C# tuples.
+		var fields []Code
+		for i, info := range infos {
+			fields = append(fields, Id(fmt.Sprintf("Item%d", i+1)).Add(info.Type))
+		}
+		file.Comment(fmt.Sprintf("%s is the tuple %s.", name, typeSignature(t)))
+		file.Type().Id(name).Struct(fields...)
+
+		// Define encoder.
+		var items []Code
+		for i, info := range infos {
+			items = append(items, info.Marshal(Id("v").Dot(fmt.Sprintf("Item%d", i+1))))
+		}
+		file.Func().Id("Encode" + name).Params(Id("v").Id(name)).Index().Byte().Block(
+			Return(Qual(krpcImportPath, "EncodeTuple").Call(items...)),
+		)
+
+		// Define decoder.
+		params := []Code{Id("b").Index().Byte()}
+		if containsClass(t) {
+			params = append([]Code{Id("conn").Op("*").Qual(krpcImportPath, "Conn")}, params...)
+		}
+		errReturn := If(Err().Op("!=").Nil()).Block(Return(Id(name).Values(), Err()))
+		block := []Code{
+			List(Id("items"), Err()).Op(":=").Qual(krpcImportPath, "DecodeTuple").Call(Id("b"), Lit(len(infos))),
+			errReturn,
+			Var().Id("v").Id(name),
+		}
+		for i, info := range infos {
+			item := fmt.Sprintf("item%d", i+1)
+			block = append(block, Id(item).Op(":=").Id("items").Index(Lit(i)))
+			result, steps := info.Unmarshal(item)
+			block = append(block, steps...)
+			if len(steps) > 0 {
+				block = append(block, errReturn)
+			}
+			block = append(block, Id("v").Dot(fmt.Sprintf("Item%d", i+1)).Op("=").Add(result))
+		}
+		block = append(block, Return(Id("v"), Nil()))
+		file.Func().Id("Decode"+name).Params(params...).Params(Id(name), Error()).Block(block...)
+	}
+
+	return files
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ilikebits/jeb/cmd/krpc-gen/service"
+)
+
+// crossServiceTuple returns services where a Drawing procedure returns a tuple
+// of a SpaceCenter enumeration and a Drawing class.
+func crossServiceTuple() service.Services {
+	return service.Services{
+		"SpaceCenter": {
+			ID: 1,
+			Procedures: map[string]service.Procedure{
+				"get_Situation": {ID: 1, ReturnType: service.Type{Code: "ENUMERATION", Service: "SpaceCenter", Name: "VesselSituation"}},
+			},
+			Enumerations: map[string]service.Enumeration{
+				"VesselSituation": {Values: []service.Value{{Name: "Landed", Value: 1}}},
+			},
+		},
+		"Drawing": {
+			ID: 2,
+			Procedures: map[string]service.Procedure{
+				"SituationLine": {ID: 1, ReturnType: service.Type{Code: "TUPLE", Types: []service.Type{
+					{Code: "ENUMERATION", Service: "SpaceCenter", Name: "VesselSituation"},
+					{Code: "CLASS", Service: "Drawing", Name: "Line"},
+				}}},
+				"Pair": {ID: 2, ReturnType: service.Type{Code: "TUPLE", Types: []service.Type{
+					{Code: "BOOL"},
+					{Code: "STRING"},
+				}}},
+			},
+			Classes: map[string]service.Class{"Line": {}},
+		},
+	}
+}
+
+// generateAll generates services in packages under packages, or in the krpc
+// package if it is empty, and returns the generated tuple files by import
+// path, and the generated service files by service name.
+func generateAll(packages string, services service.Services) (map[string]string, map[string]string) {
+	servicePackages = packages
+	tupleStructs = make(map[tupleKey]service.Type)
+	defer func() {
+		servicePackages = ""
+		tupleStructs = make(map[tupleKey]service.Type)
+		currentService = ""
+	}()
+
+	serviceFiles := make(map[string]string)
+	for _, name := range sortedServices(services) {
+		serviceFiles[name] = fmt.Sprintf("%#v", GenerateService(name, services[name]))
+	}
+	tupleFiles := make(map[string]string)
+	for path, file := range GenerateTuples() {
+		tupleFiles[path] = fmt.Sprintf("%#v", file)
+	}
+	return tupleFiles, serviceFiles
+}
+
+func TestTuplePackages(t *testing.T) {
+	const packages = "example.com/gen"
+	tuples, services := generateAll(packages, crossServiceTuple())
+
+	if len(tuples) != 2 {
+		t.Errorf("got tuple files for %d packages, want 2", len(tuples))
+	}
+	drawing := tuples[packages+"/drawing"]
+	if !strings.Contains(drawing, "type TupleVesselSituationLine struct") {
+		t.Errorf("drawing tuples do not define TupleVesselSituationLine:\n%s", drawing)
+	}
+	if _, ok := tuples[packages+"/spacecenter"]; ok {
+		t.Errorf("tuples generated in the spacecenter package")
+	}
+	if krpc := tuples[krpcImportPath]; !strings.Contains(krpc, "type TupleBoolString struct") {
+		t.Errorf("krpc tuples do not define TupleBoolString:\n%s", krpc)
+	}
+	if strings.Contains(services["SpaceCenter"], packages+"/drawing") {
+		t.Errorf("spacecenter imports drawing:\n%s", services["SpaceCenter"])
+	}
+}
+
+func TestTuplePackagesSingle(t *testing.T) {
+	tuples, _ := generateAll("", crossServiceTuple())
+
+	if len(tuples) != 1 {
+		t.Errorf("got tuple files for %d packages, want 1", len(tuples))
+	}
+	krpc := tuples[krpcImportPath]
+	for _, name := range []string{"TupleVesselSituationLine", "TupleBoolString"} {
+		if !strings.Contains(krpc, "type "+name+" struct") {
+			t.Errorf("krpc tuples do not define %s:\n%s", name, krpc)
+		}
+	}
+}
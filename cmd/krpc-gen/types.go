@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/dave/jennifer/jen"
+	"github.com/ilikebits/jeb/cmd/krpc-gen/service"
+)
+
+// Marshaller generates an expression that encodes value.
+type Marshaller func(value Code) Code
+
+// TypeGenerator generates the steps that decode the byte slice named name, and
+// an expression for the decoded value. Steps may assign err, and are followed
+// by an error check.
+type TypeGenerator func(name string) (result Code, steps []Code)
+
+type TypeInfo struct {
+	Type, Zero Code
+
+	Marshal   Marshaller
+	Unmarshal TypeGenerator
+}
+
+// GenerateType generates the Go type, zero value, and marshalling code for a
+// kRPC type. It returns an error for types the generator does not support yet.
+func GenerateType(t service.Type) (TypeInfo, error) {
+	// Generate parameter type, zero, and marshalling code.
+	switch t.Code {
+	case "SINT32":
+		return TypeInfo{
+			Type:      Int32(),
+			Zero:      Lit(0),
+			Marshal:   MarshalCodec("EncodeInt32"),
+			Unmarshal: UnmarshalCodec("DecodeInt32"),
+		}, nil
+	case "SINT64":
+		return TypeInfo{
+			Type:      Int64(),
+			Zero:      Lit(0),
+			Marshal:   MarshalCodec("EncodeInt64"),
+			Unmarshal: UnmarshalCodec("DecodeInt64"),
+		}, nil
+	case "UINT32":
+		return TypeInfo{
+			Type:      Uint32(),
+			Zero:      Lit(0),
+			Marshal:   MarshalCodec("EncodeUint32"),
+			Unmarshal: UnmarshalCodec("DecodeUint32"),
+		}, nil
+	case "UINT64":
+		return TypeInfo{
+			Type:      Uint64(),
+			Zero:      Lit(0),
+			Marshal:   MarshalCodec("EncodeUint64"),
+			Unmarshal: UnmarshalCodec("DecodeUint64"),
+		}, nil
+	case "BOOL":
+		return TypeInfo{
+			Type:      Bool(),
+			Zero:      Lit(false),
+			Marshal:   MarshalCodec("EncodeBool"),
+			Unmarshal: UnmarshalCodec("DecodeBool"),
+		}, nil
+	case "STRING":
+		return TypeInfo{
+			Type:      String(),
+			Zero:      Lit(""),
+			Marshal:   MarshalCodec("EncodeString"),
+			Unmarshal: UnmarshalCodec("DecodeString"),
+		}, nil
+	case "BYTES":
+		return TypeInfo{
+			Type:      Index().Byte(),
+			Zero:      Nil(),
+			Marshal:   MarshalCodec("EncodeBytes"),
+			Unmarshal: UnmarshalCodec("DecodeBytes"),
+		}, nil
+	case "FLOAT":
+		return TypeInfo{
+			Type:      Float32(),
+			Zero:      Lit(0.0),
+			Marshal:   MarshalCodec("EncodeFloat32"),
+			Unmarshal: UnmarshalCodec("DecodeFloat32"),
+		}, nil
+	case "DOUBLE":
+		return TypeInfo{
+			Type:      Float64(),
+			Zero:      Lit(0.0),
+			Marshal:   MarshalCodec("EncodeFloat64"),
+			Unmarshal: UnmarshalCodec("DecodeFloat64"),
+		}, nil
+	case "LIST", "SET":
+		// Sets are generated as slices like lists, since their elements, such
+		// as remote objects, are not always usable as map keys.
+		if len(t.Types) != 1 {
+			return TypeInfo{}, fmt.Errorf("%s of %d types", t.Code, len(t.Types))
+		}
+		elem, err := GenerateType(t.Types[0])
+		if err != nil {
+			return TypeInfo{}, err
+		}
+		codec := "List"
+		if t.Code == "SET" {
+			codec = "Set"
+		}
+		return TypeInfo{
+			Type:      Index().Add(elem.Type),
+			Zero:      Nil(),
+			Marshal:   MarshalSlice(codec, elem),
+			Unmarshal: UnmarshalSlice(codec, elem),
+		}, nil
+	case "DICTIONARY":
+		if len(t.Types) != 2 {
+			return TypeInfo{}, fmt.Errorf("DICTIONARY of %d types", len(t.Types))
+		}
+		if !hashable(t.Types[0]) {
+			return TypeInfo{}, fmt.Errorf("DICTIONARY with %s keys", t.Types[0].Code)
+		}
+		key, err := GenerateType(t.Types[0])
+		if err != nil {
+			return TypeInfo{}, err
+		}
+		value, err := GenerateType(t.Types[1])
+		if err != nil {
+			return TypeInfo{}, err
+		}
+		return TypeInfo{
+			Type:      Map(key.Type).Add(value.Type),
+			Zero:      Nil(),
+			Marshal:   MarshalDictionary(key, value),
+			Unmarshal: UnmarshalDictionary(key, value),
+		}, nil
+	case "TUPLE":
+		return GenerateTupleType(t)
+	case "ENUMERATION":
+		path := servicePath(t.Service)
+		return TypeInfo{
+			Type:      Qual(path, t.Name),
+			Zero:      Lit(-1),
+			Marshal:   MarshalQual(path, "Encode"+t.Name),
+			Unmarshal: UnmarshalQual(path, "Decode"+t.Name),
+		}, nil
+	case "CLASS":
+		// Decoded objects share the connection of the object or service they
+		// were returned from, which generated methods bind to conn.
+		path := servicePath(t.Service)
+		return TypeInfo{
+			Type:    Op("*").Qual(path, t.Name),
+			Zero:    Nil(),
+			Marshal: MarshalQual(path, "Encode"+t.Name),
+			Unmarshal: func(byteSlice string) (Code, []Code) {
+				decoded := byteSlice + "Decoded"
+				steps := []Code{List(Id(decoded), Err()).Op(":=").Qual(path, "Decode"+t.Name).Call(Id("conn"), Id(byteSlice))}
+				return Id(decoded), steps
+			},
+		}, nil
+	}
+	return TypeInfo{}, fmt.Errorf("unsupported type %s", t.Code)
+}
+
+// GenerateNullableType generates the type information for a nullable
+// parameter or return value. Objects, collections and byte slices are already
+// nil when null; other types are generated as pointers. Null objects are
+// encoded as object ID 0, and other null values as empty values.
+func GenerateNullableType(t service.Type) (TypeInfo, error) {
+	info, err := GenerateType(t)
+	if err != nil {
+		return TypeInfo{}, err
+	}
+	switch t.Code {
+	case "CLASS", "LIST", "SET", "DICTIONARY", "BYTES":
+		return info, nil
+	}
+
+	elem := info
+	info.Type = Op("*").Add(elem.Type)
+	info.Zero = Nil()
+	info.Marshal = func(value Code) Code {
+		return Func().Params(Id("ptr").Add(info.Type)).Index().Byte().Block(
+			If(Id("ptr").Op("==").Nil()).Block(Return(Nil())),
+			Return(elem.Marshal(Op("*").Id("ptr"))),
+		).Call(value)
+	}
+	info.Unmarshal = func(byteSlice string) (Code, []Code) {
+		decoded := byteSlice + "Decoded"
+		result, steps := elem.Unmarshal("b")
+
+		block := []Code{If(Len(Id("b")).Op("==").Lit(0)).Block(Return(Nil(), Nil()))}
+		block = append(block, steps...)
+		if len(steps) > 0 {
+			block = append(block, If(Err().Op("!=").Nil()).Block(Return(Nil(), Err())))
+		}
+		block = append(block, Id("decoded").Op(":=").Add(result), Return(Op("&").Id("decoded"), Nil()))
+
+		decode := Func().Params(Id("b").Index().Byte()).Params(info.Type, Error()).Block(block...)
+		return Id(decoded), []Code{List(Id(decoded), Err()).Op(":=").Add(decode).Call(Id(byteSlice))}
+	}
+	return info, nil
+}
+
+// typeSignature describes a type by its code and element types, such as
+// "(DOUBLE, DOUBLE)" for a pair of doubles.
+func typeSignature(t service.Type) string {
+	var elems []string
+	for _, elem := range t.Types {
+		elems = append(elems, typeSignature(elem))
+	}
+	switch t.Code {
+	case "TUPLE":
+		return "(" + strings.Join(elems, ", ") + ")"
+	case "CLASS", "ENUMERATION":
+		return t.Service + "." + t.Name
+	case "LIST", "SET", "DICTIONARY":
+		return t.Code + "(" + strings.Join(elems, ", ") + ")"
+	}
+	return t.Code
+}
+
+// hashable reports whether values of t can be used as Go map keys.
+func hashable(t service.Type) bool {
+	switch t.Code {
+	case "LIST", "SET", "DICTIONARY", "BYTES":
+		return false
+	}
+	for _, elem := range t.Types {
+		if !hashable(elem) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsClass reports whether decoding t produces remote objects, which need
+// a connection.
+func containsClass(t service.Type) bool {
+	if t.Code == "CLASS" {
+		return true
+	}
+	for _, elem := range t.Types {
+		if containsClass(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalCodec marshals a value using the named encoding function from the
+// krpc package, so that generated code and streams share one codec.
+func MarshalCodec(encode string) Marshaller {
+	return MarshalQual(krpcImportPath, encode)
+}
+
+// UnmarshalCodec unmarshals a value using the named decoding function from the
+// krpc package.
+func UnmarshalCodec(decode string) TypeGenerator {
+	return UnmarshalQual(krpcImportPath, decode)
+}
+
+// MarshalQual marshals a value using the named encoding function from the
+// package at path, such as the codec generated for a class or enumeration.
+func MarshalQual(path, encode string) Marshaller {
+	return func(value Code) Code {
+		return Qual(path, encode).Call(value)
+	}
+}
+
+// UnmarshalQual unmarshals a value using the named decoding function from the
+// package at path.
+func UnmarshalQual(path, decode string) TypeGenerator {
+	return func(byteSlice string) (Code, []Code) {
+		decoded := byteSlice + "Decoded"
+		steps := []Code{
+			List(Id(decoded), Err()).Op(":=").Qual(path, decode).Call(Id(byteSlice)),
+		}
+		return Id(decoded), steps
+	}
+}
+
+// MarshalSlice marshals a slice by marshalling each of its elements into the
+// items of the named collection codec.
+func MarshalSlice(codec string, elem TypeInfo) Marshaller {
+	return func(value Code) Code {
+		return Qual(krpcImportPath, "Encode"+codec).Call(
+			Func().Params(Id("elems").Index().Add(elem.Type)).Index().Index().Byte().Block(
+				Id("items").Op(":=").Make(Index().Index().Byte(), Len(Id("elems"))),
+				For(List(Id("i"), Id("elem")).Op(":=").Range().Id("elems")).Block(
+					Id("items").Index(Id("i")).Op("=").Add(elem.Marshal(Id("elem"))),
+				),
+				Return(Id("items")),
+			).Call(value),
+		)
+	}
+}
+
+// UnmarshalSlice unmarshals the items of the named collection codec into a
+// slice. Since element decoding takes several steps, it is done in a function
+// literal so that a single error check follows.
+func UnmarshalSlice(codec string, elem TypeInfo) TypeGenerator {
+	return func(byteSlice string) (Code, []Code) {
+		decoded := byteSlice + "Decoded"
+		result, steps := elem.Unmarshal("item")
+
+		var loop []Code
+		loop = append(loop, steps...)
+		if len(steps) > 0 {
+			loop = append(loop, If(Err().Op("!=").Nil()).Block(Return(Nil(), Err())))
+		}
+		loop = append(loop, Id("elems").Index(Id("i")).Op("=").Add(result))
+
+		decode := Func().Params(Id("b").Index().Byte()).Params(Index().Add(elem.Type), Error()).Block(
+			List(Id("items"), Err()).Op(":=").Qual(krpcImportPath, "Decode"+codec).Call(Id("b")),
+			If(Err().Op("!=").Nil()).Block(Return(Nil(), Err())),
+			Id("elems").Op(":=").Make(Index().Add(elem.Type), Len(Id("items"))),
+			For(List(Id("i"), Id("item")).Op(":=").Range().Id("items")).Block(loop...),
+			Return(Id("elems"), Nil()),
+		)
+		return Id(decoded), []Code{List(Id(decoded), Err()).Op(":=").Add(decode).Call(Id(byteSlice))}
+	}
+}
+
+// MarshalDictionary marshals a map into dictionary entries.
+func MarshalDictionary(key, value TypeInfo) Marshaller {
+	return func(dict Code) Code {
+		return Qual(krpcImportPath, "EncodeDictionary").Call(
+			Func().Params(Id("dict").Map(key.Type).Add(value.Type)).Params(
+				Id("keys"), Id("values").Index().Index().Byte(),
+			).Block(
+				For(List(Id("key"), Id("value")).Op(":=").Range().Id("dict")).Block(
+					Id("keys").Op("=").Append(Id("keys"), key.Marshal(Id("key"))),
+					Id("values").Op("=").Append(Id("values"), value.Marshal(Id("value"))),
+				),
+				Return(Id("keys"), Id("values")),
+			).Call(dict),
+		)
+	}
+}
+
+// UnmarshalDictionary unmarshals dictionary entries into a map.
+func UnmarshalDictionary(key, value TypeInfo) TypeGenerator {
+	return func(byteSlice string) (Code, []Code) {
+		decoded := byteSlice + "Decoded"
+		keyResult, keySteps := key.Unmarshal("key")
+		valueResult, valueSteps := value.Unmarshal("value")
+
+		errReturn := If(Err().Op("!=").Nil()).Block(Return(Nil(), Err()))
+		loop := []Code{
+			Id("key").Op(":=").Id("keys").Index(Id("i")),
+			Id("value").Op(":=").Id("values").Index(Id("i")),
+		}
+		loop = append(loop, keySteps...)
+		if len(keySteps) > 0 {
+			loop = append(loop, errReturn)
+		}
+		loop = append(loop, valueSteps...)
+		if len(valueSteps) > 0 {
+			loop = append(loop, errReturn)
+		}
+		loop = append(loop, Id("dict").Index(keyResult).Op("=").Add(valueResult))
+
+		decode := Func().Params(Id("b").Index().Byte()).Params(Map(key.Type).Add(value.Type), Error()).Block(
+			List(Id("keys"), Id("values"), Err()).Op(":=").Qual(krpcImportPath, "DecodeDictionary").Call(Id("b")),
+			errReturn,
+			Id("dict").Op(":=").Make(Map(key.Type).Add(value.Type), Len(Id("keys"))),
+			For(Id("i").Op(":=").Range().Id("keys")).Block(loop...),
+			Return(Id("dict"), Nil()),
+		)
+		return Id(decoded), []Code{List(Id(decoded), Err()).Op(":=").Add(decode).Call(Id(byteSlice))}
+	}
+}
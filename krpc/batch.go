@@ -0,0 +1,91 @@
+package krpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// Batch is a list of procedure calls that are made in a single request. Add
+// calls with the "Call" methods of generated types, such as
+// Flight.SurfaceAltitudeCall, then make them all with Execute:
+//
+//	b := c.Batch()
+//	altitude := b.Add(flight.SurfaceAltitudeCall())
+//	speed := b.Add(flight.SpeedCall())
+//	results, err := b.Execute()
+//	...
+//	alt, err := DecodeFloat64(results[altitude].Value)
+//
+// A Batch is not safe for concurrent use.
+type Batch struct {
+	conn  *Conn
+	calls []*pb.ProcedureCall
+}
+
+// BatchResult is the result of one call in a batch. Value is the encoded
+// return value of the procedure, which should be decoded with the codec for
+// its type. Err is the error thrown by the procedure, if any.
+type BatchResult struct {
+	Value []byte
+	Err   error
+}
+
+// Batch returns an empty batch of calls.
+func (c *Client) Batch() *Batch {
+	return &Batch{conn: c.conn}
+}
+
+// Add adds call to the batch and returns the index of its result.
+func (b *Batch) Add(call *pb.ProcedureCall) int {
+	b.calls = append(b.calls, call)
+	return len(b.calls) - 1
+}
+
+// Len returns the number of calls in the batch.
+func (b *Batch) Len() int {
+	return len(b.calls)
+}
+
+// Execute makes every call in the batch in a single request, and returns
+// their results in the order the calls were added. The returned error is set
+// only if the request as a whole failed; errors thrown by individual
+// procedures are returned in their results. The batch can be executed again.
+func (b *Batch) Execute() ([]BatchResult, error) {
+	return b.ExecuteContext(context.Background())
+}
+
+// ExecuteContext is like Execute, but gives up waiting for the server when ctx
+// is done.
+func (b *Batch) ExecuteContext(ctx context.Context) ([]BatchResult, error) {
+	if len(b.calls) == 0 {
+		return nil, nil
+	}
+
+	start := time.Now()
+	res, err := b.conn.Call(ctx, &pb.Request{
+		Calls: b.calls,
+	})
+	b.conn.log.Log(LevelDebug, "batch", Field{"calls", len(b.calls)}, Field{"latency", time.Since(start)})
+	if err != nil {
+		return nil, err
+	}
+	if e := res.GetError(); e != nil {
+		return nil, newError(e)
+	}
+	if len(res.GetResults()) != len(b.calls) {
+		return nil, errors.Errorf("batch of %d calls returned %d results", len(b.calls), len(res.GetResults()))
+	}
+
+	results := make([]BatchResult, len(b.calls))
+	for i, result := range res.GetResults() {
+		results[i].Value = result.GetValue()
+		if e := result.GetError(); e != nil {
+			results[i].Err = newError(e)
+		}
+	}
+	return results, nil
+}
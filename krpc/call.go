@@ -0,0 +1,177 @@
+package krpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// The server answers requests in the order it receives them, so the
+// connection pipelines calls: each request is queued and written under a lock,
+// and a single goroutine reads responses and hands each one to the oldest
+// waiting call.
+
+// ErrUnexpectedResponse is returned when the server sends a response that no
+// call is waiting for.
+var ErrUnexpectedResponse = errors.New("unexpected response")
+
+type callResult struct {
+	res *pb.Response
+	err error
+}
+
+// callQueue holds the calls on a connection that are waiting for responses.
+type callQueue struct {
+	start sync.Once
+
+	// writeMu serializes writing requests and queueing their calls, so that
+	// calls are queued in the order their requests are sent.
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending []chan callResult
+	err     error
+}
+
+// Call sends req and waits for its response. It is safe to call from many
+// goroutines at once; requests are sent in the order Call is called, and the
+// server may process a request while earlier ones are still in flight.
+//
+// The deadline of ctx applies to writing the request. If ctx is done before
+// the response arrives, Call returns ctx.Err(), and the response is discarded
+// when it arrives. If ctx is done while the request is being written, the
+// connection is closed, since the server can no longer read it. Call must not
+// be used on a connection that is also read with Read.
+func (c *Conn) Call(ctx context.Context, req *pb.Request) (*pb.Response, error) {
+	c.calls.start.Do(func() {
+		go c.readResponses()
+	})
+
+	done := make(chan callResult, 1)
+
+	c.calls.writeMu.Lock()
+	if err := ctx.Err(); err != nil {
+		c.calls.writeMu.Unlock()
+		return nil, err
+	}
+	c.calls.mu.Lock()
+	if err := c.calls.err; err != nil {
+		c.calls.mu.Unlock()
+		c.calls.writeMu.Unlock()
+		return nil, err
+	}
+	c.calls.pending = append(c.calls.pending, done)
+	c.calls.mu.Unlock()
+	conn := c.conn
+	stop := watchContext(ctx, conn.SetWriteDeadline)
+	_, err := c.Send(req)
+	stop()
+	c.calls.writeMu.Unlock()
+
+	if err != nil {
+		// A partially written request leaves the connection unusable. Closing
+		// it stops the reader, which fails every queued call.
+		conn.Close()
+		return nil, contextError(ctx, err)
+	}
+
+	select {
+	case result := <-done:
+		return result.res, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readResponses reads responses until the connection fails, delivering each
+// to the oldest queued call.
+func (c *Conn) readResponses() {
+	conn := c.conn
+	for {
+		res := pb.Response{}
+		err := c.Read(&res)
+		if err != nil {
+			c.failCalls(err)
+			return
+		}
+
+		c.calls.mu.Lock()
+		if len(c.calls.pending) == 0 {
+			c.calls.mu.Unlock()
+			conn.Close()
+			c.failCalls(ErrUnexpectedResponse)
+			return
+		}
+		done := c.calls.pending[0]
+		c.calls.pending = c.calls.pending[1:]
+		c.calls.mu.Unlock()
+
+		done <- callResult{res: &res}
+	}
+}
+
+// failCalls fails every queued call and all future calls with err. If the
+// connection reconnects, err is wrapped in a SessionLostError, and calls made
+// after reconnecting succeed.
+func (c *Conn) failCalls(err error) {
+	c.calls.mu.Lock()
+	defer c.calls.mu.Unlock()
+
+	if c.calls.err == nil {
+		c.log.Log(LevelInfo, "connection closed", Field{"error", err}, Field{"pending", len(c.calls.pending)})
+		switch {
+		case c.opts.reconnect == nil || c.closed:
+		case c.redial == nil:
+			c.log.Log(LevelWarn, "not reconnecting a connection that was not dialed", Field{"addr", c.addr})
+		default:
+			err = &SessionLostError{Err: err}
+			go c.reconnect()
+		}
+		c.calls.err = err
+	}
+	for _, done := range c.calls.pending {
+		done <- callResult{err: c.calls.err}
+	}
+	c.calls.pending = nil
+}
+
+// watchContext applies the deadline of ctx using setDeadline, and interrupts
+// blocked I/O by setting a deadline in the past if ctx is done early. Calling
+// the returned function clears the deadline.
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		setDeadline(deadline)
+	}
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		setDeadline(time.Time{})
+	}
+}
+
+// contextError returns ctx.Err() in place of err if ctx is done, since I/O
+// errors caused by watchContext report only a timeout.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
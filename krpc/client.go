@@ -1,9 +1,19 @@
 package krpc
 
+import (
+	"context"
+)
+
 type Client struct {
 	conn *Conn
 
 	KRPC KRPC
+	// Stream is the stream connection, or nil if it was disabled with
+	// WithStream.
+	Stream *StreamClient
+
+	// schema caches the server's services for Invoke.
+	schema schema
 }
 
 type Point struct {
@@ -22,19 +32,87 @@ type BoundingBox struct {
 	Min, Max Vector
 }
 
-func Dial(addr string) (*Client, error) {
-	conn, err := Connect(addr)
+// Dial connects to the kRPC RPC server at addr and, unless disabled with
+// WithStream, to the stream server. The stream server is assumed to be on the
+// next port of the same host unless WithStreamAddr is used.
+func Dial(addr string, opts ...Option) (*Client, error) {
+	return DialContext(context.Background(), addr, opts...)
+}
+
+// DialContext is like Dial, but gives up on connecting when ctx is done.
+func DialContext(ctx context.Context, addr string, opts ...Option) (*Client, error) {
+	o := newOptions(opts)
+	streamAddr := o.streamAddr
+	if o.stream && streamAddr == "" && o.streamConn == nil {
+		var err error
+		streamAddr, err = defaultStreamAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := ConnectContext(ctx, addr, opts...)
 	if err != nil {
 		return nil, err
 	}
 
+	var stream *StreamClient
+	if o.stream {
+		stream, err = DialStreamContext(ctx, streamAddr, conn.ID(), opts...)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return newClient(conn, stream, o, func(ctx context.Context, id []byte) (*Conn, error) {
+		if o.streamConn != nil {
+			return nil, errNotDialed
+		}
+		return connect(ctx, streamAddr, streamRequest(id), nil, o)
+	}), nil
+}
+
+// newClient returns a client using the RPC connection conn and the stream
+// connection stream, which may be nil. If the client reconnects, dialStream is
+// used to open a new stream connection for the client identifier id.
+func newClient(conn *Conn, stream *StreamClient, o options, dialStream func(ctx context.Context, id []byte) (*Conn, error)) *Client {
 	client := Client{
 		conn: conn,
 
 		KRPC: KRPC{
-			conn: conn,
+			conn:   conn,
+			stream: stream,
 		},
+		Stream: stream,
 	}
+	if o.reconnect != nil {
+		conn.setOnReconnect(func(err error) {
+			client.schema.reset()
+			client.restore(dialStream, err)
+		})
+		if stream != nil {
+			stream.setOnLost(func(lost *Conn, err error) {
+				client.redialStream(dialStream, lost, err)
+			})
+		}
+	}
+	return &client
+}
 
-	return &client, nil
+// Conn returns the RPC connection of the client. Service packages generated
+// with krpc-gen -packages make their calls on it.
+func (c *Client) Conn() *Conn {
+	return c.conn
+}
+
+func (c *Client) Close() error {
+	var err error
+	if c.Stream != nil {
+		err = c.Stream.Close()
+	}
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
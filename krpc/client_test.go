@@ -0,0 +1,277 @@
+package krpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+func TestDial(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.handle("KRPC", "GetStatus", func(*pb.ProcedureCall) *pb.ProcedureResult {
+		b, _ := proto.Marshal(&pb.Status{Version: "0.4.8"})
+		return &pb.ProcedureResult{Value: b}
+	})
+
+	c := dial(t, srv)
+	defer c.Close()
+
+	status, err := c.KRPC.GetStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.GetVersion() != "0.4.8" {
+		t.Errorf("got version %q, want 0.4.8", status.GetVersion())
+	}
+
+	// Updates are dispatched to the handler of their stream.
+	results := make(chan *pb.ProcedureResult, 1)
+	c.Stream.Subscribe(1, func(result *pb.ProcedureResult) { results <- result })
+	err = srv.update(&pb.StreamUpdate{Results: []*pb.StreamResult{
+		{Id: 2, Result: &pb.ProcedureResult{Value: []byte{2}}},
+		{Id: 1, Result: &pb.ProcedureResult{Value: []byte{1}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case result := <-results:
+		if string(result.GetValue()) != "\x01" {
+			t.Errorf("got result %v for stream 1", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update for stream 1")
+	}
+
+	// A handler subscribed after an update gets the latest value.
+	c.Stream.Subscribe(2, func(result *pb.ProcedureResult) { results <- result })
+	select {
+	case result := <-results:
+		if string(result.GetValue()) != "\x02" {
+			t.Errorf("got result %v for stream 2", result)
+		}
+	default:
+		t.Error("no latest value for stream 2")
+	}
+
+	srv.Close()
+	select {
+	case <-c.Stream.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream client did not stop")
+	}
+	if c.Stream.Err() == nil {
+		t.Error("stream client stopped without an error")
+	}
+}
+
+// testException is an exception type registered by a test service.
+type testException struct{ Exception }
+
+func TestException(t *testing.T) {
+	RegisterException("Test", "TestException", func(e Exception) error { return &testException{e} })
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.handle("Test", "Fail", func(call *pb.ProcedureCall) *pb.ProcedureResult {
+		name, _ := DecodeString(call.GetArguments()[0].GetValue())
+		return &pb.ProcedureResult{Error: &pb.Error{Service: "Test", Name: name, Description: "failed"}}
+	})
+	c := dial(t, srv)
+	defer c.Close()
+
+	fail := func(name string) error {
+		_, err := c.conn.Invoke(context.Background(), &pb.ProcedureCall{
+			Service:   "Test",
+			Procedure: "Fail",
+			Arguments: []*pb.Argument{{Position: 0, Value: EncodeString(name)}},
+		})
+		return err
+	}
+	if e, ok := fail("TestException").(*testException); !ok || e.Description != "failed" {
+		t.Errorf("got %#v, want a registered testException", e)
+	}
+	err := fail("OtherException")
+	if e, ok := err.(*Exception); !ok || e.Service != "Test" || e.Name != "OtherException" {
+		t.Errorf("got %#v, want an Exception", err)
+	}
+	if _, err := c.conn.Invoke(context.Background(), &pb.ProcedureCall{Service: "Test", Procedure: "Missing"}); err == nil {
+		t.Error("call of a missing procedure succeeded")
+	} else if _, ok := err.(*InvalidOperationException); !ok {
+		t.Errorf("got %#v, want an InvalidOperationException", err)
+	}
+}
+
+// handleEcho registers Test.Echo, which returns its string argument.
+func handleEcho(srv *testServer) {
+	srv.handle("Test", "Echo", func(call *pb.ProcedureCall) *pb.ProcedureResult {
+		return &pb.ProcedureResult{Value: call.GetArguments()[0].GetValue()}
+	})
+}
+
+// echo calls Test.Echo with s.
+func echo(ctx context.Context, c *Client, s string) (string, error) {
+	b, err := c.conn.Invoke(ctx, &pb.ProcedureCall{
+		Service:   "Test",
+		Procedure: "Echo",
+		Arguments: []*pb.Argument{{Position: 0, Value: EncodeString(s)}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return DecodeString(b)
+}
+
+func TestPipelining(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	c := dial(t, srv)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				want := fmt.Sprintf("%d.%d", i, j)
+				got, err := echo(context.Background(), c, want)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got != want {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Calls fail once the connection is closed.
+	srv.Close()
+	if _, err := echo(context.Background(), c, "closed"); err == nil {
+		t.Error("call succeeded after the server closed")
+	}
+}
+
+func TestContext(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	release := make(chan struct{})
+	srv.handle("Test", "Wait", func(*pb.ProcedureCall) *pb.ProcedureResult {
+		<-release
+		return &pb.ProcedureResult{}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialContext(ctx, srv.Addr(), WithStreamAddr(srv.StreamAddr())); err == nil {
+		t.Fatal("dialed with a canceled context")
+	}
+
+	c := dial(t, srv)
+	defer c.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.conn.Invoke(ctx, &pb.ProcedureCall{Service: "Test", Procedure: "Wait"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The late response is discarded, and later calls get their own.
+	close(release)
+	if got, err := echo(context.Background(), c, "after"); err != nil || got != "after" {
+		t.Errorf("got %q, %v, want after", got, err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	c := dial(t, srv)
+	defer c.Close()
+
+	b := c.Batch()
+	if results, err := b.Execute(); err != nil || len(results) != 0 {
+		t.Errorf("empty batch: got %v, %v", results, err)
+	}
+	first := b.Add(&pb.ProcedureCall{Service: "Test", Procedure: "Echo", Arguments: []*pb.Argument{{Value: EncodeString("a")}}})
+	missing := b.Add(&pb.ProcedureCall{Service: "Test", Procedure: "Missing"})
+	second := b.Add(&pb.ProcedureCall{Service: "Test", Procedure: "Echo", Arguments: []*pb.Argument{{Value: EncodeString("b")}}})
+	results, err := b.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != b.Len() {
+		t.Fatalf("got %d results, want %d", len(results), b.Len())
+	}
+	for i, want := range map[int]string{first: "a", second: "b"} {
+		got, err := DecodeString(results[i].Value)
+		if results[i].Err != nil || err != nil || got != want {
+			t.Errorf("result %d: got %q, %v, %v, want %q", i, got, results[i].Err, err, want)
+		}
+	}
+	if _, ok := results[missing].Err.(*InvalidOperationException); !ok {
+		t.Errorf("call of a missing procedure: got error %#v", results[missing].Err)
+	}
+}
+
+func TestDialOptions(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+
+	c := dial(t, srv)
+	c.Close()
+	if name := srv.clientName(); name != DefaultClientName {
+		t.Errorf("got client name %q, want %q", name, DefaultClientName)
+	}
+
+	c = dial(t, srv, WithClientName("test"), WithStream(false))
+	defer c.Close()
+	if name := srv.clientName(); name != "test" {
+		t.Errorf("got client name %q, want test", name)
+	}
+	if c.Stream != nil {
+		t.Error("stream connection opened with WithStream(false)")
+	}
+	if _, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "Test", Procedure: "Echo"}, true); err != ErrNoStreamClient {
+		t.Errorf("AddStream without a stream connection: got %v, want %v", err, ErrNoStreamClient)
+	}
+
+	// The handshake is made over connections passed in.
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := Dial("unused", WithConn(conn), WithStream(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if got, err := echo(context.Background(), c2, "hello"); err != nil || got != "hello" {
+		t.Errorf("got %q, %v, want hello", got, err)
+	}
+}
+
+func TestDefaultStreamAddr(t *testing.T) {
+	addr, err := defaultStreamAddr("127.0.0.1:50000")
+	if err != nil || addr != "127.0.0.1:50001" {
+		t.Errorf("got %q, %v, want 127.0.0.1:50001", addr, err)
+	}
+	if _, err := defaultStreamAddr("127.0.0.1"); err == nil {
+		t.Error("got a stream address for an address without a port")
+	}
+}
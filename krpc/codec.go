@@ -0,0 +1,320 @@
+package krpc
+
+import (
+	"math"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// Values are encoded as bare protobuf fields without tags, as described in the
+// kRPC protocol documentation. These functions are shared by hand-written
+// wrappers, streams and the code generated by krpc-gen so that every path
+// agrees about encoding.
+
+func EncodeFloat64(v float64) []byte {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeFixed64(math.Float64bits(v))
+	return buf.Bytes()
+}
+
+func DecodeFloat64(b []byte) (float64, error) {
+	v, err := proto.NewBuffer(b).DecodeFixed64()
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(v), nil
+}
+
+func EncodeFloat32(v float32) []byte {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeFixed32(uint64(math.Float32bits(v)))
+	return buf.Bytes()
+}
+
+func DecodeFloat32(b []byte) (float32, error) {
+	v, err := proto.NewBuffer(b).DecodeFixed32()
+	if err != nil {
+		return 0, err
+	}
+	return math.Float32frombits(uint32(v)), nil
+}
+
+func EncodeInt32(v int32) []byte {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeZigzag32(uint64(v))
+	return buf.Bytes()
+}
+
+func DecodeInt32(b []byte) (int32, error) {
+	v, err := proto.NewBuffer(b).DecodeZigzag32()
+	if err != nil {
+		return 0, err
+	}
+	return int32(v), nil
+}
+
+func EncodeInt64(v int64) []byte {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeZigzag64(uint64(v))
+	return buf.Bytes()
+}
+
+func DecodeInt64(b []byte) (int64, error) {
+	v, err := proto.NewBuffer(b).DecodeZigzag64()
+	if err != nil {
+		return 0, err
+	}
+	return int64(v), nil
+}
+
+func EncodeUint32(v uint32) []byte {
+	return proto.EncodeVarint(uint64(v))
+}
+
+func DecodeUint32(b []byte) (uint32, error) {
+	v, err := proto.NewBuffer(b).DecodeVarint()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(v), nil
+}
+
+func EncodeUint64(v uint64) []byte {
+	return proto.EncodeVarint(v)
+}
+
+func DecodeUint64(b []byte) (uint64, error) {
+	return proto.NewBuffer(b).DecodeVarint()
+}
+
+func EncodeBool(v bool) []byte {
+	if v {
+		return proto.EncodeVarint(1)
+	}
+	return proto.EncodeVarint(0)
+}
+
+func DecodeBool(b []byte) (bool, error) {
+	v, err := proto.NewBuffer(b).DecodeVarint()
+	if err != nil {
+		return false, err
+	}
+	return v != 0, nil
+}
+
+func EncodeString(v string) []byte {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeStringBytes(v)
+	return buf.Bytes()
+}
+
+func DecodeString(b []byte) (string, error) {
+	return proto.NewBuffer(b).DecodeStringBytes()
+}
+
+func EncodeBytes(v []byte) []byte {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeRawBytes(v)
+	return buf.Bytes()
+}
+
+func DecodeBytes(b []byte) ([]byte, error) {
+	return proto.NewBuffer(b).DecodeRawBytes(true)
+}
+
+// EncodeObject encodes the ID of a remote object. Object ID 0 represents null.
+func EncodeObject(id uint64) []byte {
+	return EncodeUint64(id)
+}
+
+func DecodeObject(b []byte) (uint64, error) {
+	return DecodeUint64(b)
+}
+
+// Enumeration values are encoded as sint32.
+
+func EncodeEnum(v int32) []byte {
+	return EncodeInt32(v)
+}
+
+func DecodeEnum(b []byte) (int32, error) {
+	return DecodeInt32(b)
+}
+
+// EncodeMessage encodes a protobuf message value, such as a ProcedureCall
+// argument.
+func EncodeMessage(msg proto.Message) ([]byte, error) {
+	return proto.Marshal(msg)
+}
+
+func DecodeMessage(b []byte, msg proto.Message) error {
+	return proto.Unmarshal(b, msg)
+}
+
+func EncodePoint(v Point) []byte {
+	return EncodeTuple(EncodeFloat64(v.X), EncodeFloat64(v.Y))
+}
+
+func DecodePoint(b []byte) (Point, error) {
+	items, err := DecodeTuple(b, 2)
+	if err != nil {
+		return Point{}, err
+	}
+	var v Point
+	if v.X, err = DecodeFloat64(items[0]); err != nil {
+		return Point{}, err
+	}
+	if v.Y, err = DecodeFloat64(items[1]); err != nil {
+		return Point{}, err
+	}
+	return v, nil
+}
+
+func EncodeVector(v Vector) []byte {
+	return EncodeTuple(EncodeFloat64(v.X), EncodeFloat64(v.Y), EncodeFloat64(v.Z))
+}
+
+func DecodeVector(b []byte) (Vector, error) {
+	items, err := DecodeTuple(b, 3)
+	if err != nil {
+		return Vector{}, err
+	}
+	var v Vector
+	if v.X, err = DecodeFloat64(items[0]); err != nil {
+		return Vector{}, err
+	}
+	if v.Y, err = DecodeFloat64(items[1]); err != nil {
+		return Vector{}, err
+	}
+	if v.Z, err = DecodeFloat64(items[2]); err != nil {
+		return Vector{}, err
+	}
+	return v, nil
+}
+
+func EncodeQuaternion(v Quaternion) []byte {
+	return EncodeTuple(EncodeFloat64(v.A), EncodeFloat64(v.B), EncodeFloat64(v.C), EncodeFloat64(v.D))
+}
+
+func DecodeQuaternion(b []byte) (Quaternion, error) {
+	items, err := DecodeTuple(b, 4)
+	if err != nil {
+		return Quaternion{}, err
+	}
+	var v Quaternion
+	if v.A, err = DecodeFloat64(items[0]); err != nil {
+		return Quaternion{}, err
+	}
+	if v.B, err = DecodeFloat64(items[1]); err != nil {
+		return Quaternion{}, err
+	}
+	if v.C, err = DecodeFloat64(items[2]); err != nil {
+		return Quaternion{}, err
+	}
+	if v.D, err = DecodeFloat64(items[3]); err != nil {
+		return Quaternion{}, err
+	}
+	return v, nil
+}
+
+func EncodeBoundingBox(v BoundingBox) []byte {
+	return EncodeTuple(EncodeVector(v.Min), EncodeVector(v.Max))
+}
+
+func DecodeBoundingBox(b []byte) (BoundingBox, error) {
+	items, err := DecodeTuple(b, 2)
+	if err != nil {
+		return BoundingBox{}, err
+	}
+	var v BoundingBox
+	if v.Min, err = DecodeVector(items[0]); err != nil {
+		return BoundingBox{}, err
+	}
+	if v.Max, err = DecodeVector(items[1]); err != nil {
+		return BoundingBox{}, err
+	}
+	return v, nil
+}
+
+// Collections are encoded as protobuf messages whose items are themselves
+// encoded values. The generated code encodes and decodes the items.
+
+// EncodeTuple encodes a tuple of encoded items.
+func EncodeTuple(items ...[]byte) []byte {
+	// Marshalling a message with only repeated bytes fields cannot fail.
+	b, _ := proto.Marshal(&pb.Tuple{Items: items})
+	return b
+}
+
+// DecodeTuple decodes a tuple, checking that it has arity items.
+func DecodeTuple(b []byte, arity int) ([][]byte, error) {
+	tuple := pb.Tuple{}
+	err := proto.Unmarshal(b, &tuple)
+	if err != nil {
+		return nil, err
+	}
+	if len(tuple.GetItems()) != arity {
+		return nil, errors.Errorf("expected tuple of %d items, got %d", arity, len(tuple.GetItems()))
+	}
+	return tuple.GetItems(), nil
+}
+
+func EncodeList(items [][]byte) []byte {
+	b, _ := proto.Marshal(&pb.List{Items: items})
+	return b
+}
+
+func DecodeList(b []byte) ([][]byte, error) {
+	list := pb.List{}
+	err := proto.Unmarshal(b, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list.GetItems(), nil
+}
+
+func EncodeSet(items [][]byte) []byte {
+	b, _ := proto.Marshal(&pb.Set{Items: items})
+	return b
+}
+
+func DecodeSet(b []byte) ([][]byte, error) {
+	set := pb.Set{}
+	err := proto.Unmarshal(b, &set)
+	if err != nil {
+		return nil, err
+	}
+	return set.GetItems(), nil
+}
+
+// EncodeDictionary encodes a dictionary from its encoded keys and the encoded
+// values at the same indices.
+func EncodeDictionary(keys, values [][]byte) []byte {
+	dict := pb.Dictionary{}
+	for i := range keys {
+		dict.Entries = append(dict.Entries, &pb.DictionaryEntry{
+			Key:   keys[i],
+			Value: values[i],
+		})
+	}
+	b, _ := proto.Marshal(&dict)
+	return b
+}
+
+// DecodeDictionary decodes a dictionary into its encoded keys and the encoded
+// values at the same indices.
+func DecodeDictionary(b []byte) (keys, values [][]byte, err error) {
+	dict := pb.Dictionary{}
+	err = proto.Unmarshal(b, &dict)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range dict.GetEntries() {
+		keys = append(keys, entry.GetKey())
+		values = append(values, entry.GetValue())
+	}
+	return keys, values, nil
+}
@@ -0,0 +1,123 @@
+package krpc_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ilikebits/jeb/krpc"
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		encode func(v interface{}) []byte
+		decode func(b []byte) (interface{}, error)
+	}{
+		{"float64", 1.5,
+			func(v interface{}) []byte { return krpc.EncodeFloat64(v.(float64)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeFloat64(b) }},
+		{"float32", float32(-2.25),
+			func(v interface{}) []byte { return krpc.EncodeFloat32(v.(float32)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeFloat32(b) }},
+		{"int32", int32(-300),
+			func(v interface{}) []byte { return krpc.EncodeInt32(v.(int32)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeInt32(b) }},
+		{"int64", int64(-1) << 40,
+			func(v interface{}) []byte { return krpc.EncodeInt64(v.(int64)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeInt64(b) }},
+		{"uint32", uint32(1) << 31,
+			func(v interface{}) []byte { return krpc.EncodeUint32(v.(uint32)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeUint32(b) }},
+		{"uint64", uint64(1) << 63,
+			func(v interface{}) []byte { return krpc.EncodeUint64(v.(uint64)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeUint64(b) }},
+		{"bool", true,
+			func(v interface{}) []byte { return krpc.EncodeBool(v.(bool)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeBool(b) }},
+		{"string", "Kerbal X",
+			func(v interface{}) []byte { return krpc.EncodeString(v.(string)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeString(b) }},
+		{"bytes", []byte{0, 1, 2},
+			func(v interface{}) []byte { return krpc.EncodeBytes(v.([]byte)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeBytes(b) }},
+		{"object", uint64(42),
+			func(v interface{}) []byte { return krpc.EncodeObject(v.(uint64)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeObject(b) }},
+		{"enum", int32(-1),
+			func(v interface{}) []byte { return krpc.EncodeEnum(v.(int32)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeEnum(b) }},
+		{"vector", krpc.Vector{X: 1, Y: -2, Z: 3.5},
+			func(v interface{}) []byte { return krpc.EncodeVector(v.(krpc.Vector)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeVector(b) }},
+		{"quaternion", krpc.Quaternion{A: 0, B: 0.5, C: -0.5, D: 1},
+			func(v interface{}) []byte { return krpc.EncodeQuaternion(v.(krpc.Quaternion)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeQuaternion(b) }},
+		{"bounding box", krpc.BoundingBox{Min: krpc.Vector{X: -1, Y: -2, Z: -3}, Max: krpc.Vector{X: 1, Y: 2, Z: 3}},
+			func(v interface{}) []byte { return krpc.EncodeBoundingBox(v.(krpc.BoundingBox)) },
+			func(b []byte) (interface{}, error) { return krpc.DecodeBoundingBox(b) }},
+	}
+	for _, test := range tests {
+		got, err := test.decode(test.encode(test.value))
+		if err != nil {
+			t.Errorf("%s: decode: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.value) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.value)
+		}
+	}
+}
+
+func TestCodecCollections(t *testing.T) {
+	items := [][]byte{krpc.EncodeString("a"), krpc.EncodeString("b")}
+
+	list, err := krpc.DecodeList(krpc.EncodeList(items))
+	if err != nil || !reflect.DeepEqual(list, items) {
+		t.Errorf("list: got %q, %v, want %q", list, err, items)
+	}
+	set, err := krpc.DecodeSet(krpc.EncodeSet(items))
+	if err != nil || !reflect.DeepEqual(set, items) {
+		t.Errorf("set: got %q, %v, want %q", set, err, items)
+	}
+	tuple, err := krpc.DecodeTuple(krpc.EncodeTuple(items...), 2)
+	if err != nil || !reflect.DeepEqual(tuple, items) {
+		t.Errorf("tuple: got %q, %v, want %q", tuple, err, items)
+	}
+	if _, err := krpc.DecodeTuple(krpc.EncodeTuple(items...), 3); err == nil {
+		t.Errorf("tuple of 2 items decoded with arity 3")
+	}
+
+	values := [][]byte{krpc.EncodeInt32(1), krpc.EncodeInt32(2)}
+	keys, vals, err := krpc.DecodeDictionary(krpc.EncodeDictionary(items, values))
+	if err != nil || !reflect.DeepEqual(keys, items) || !reflect.DeepEqual(vals, values) {
+		t.Errorf("dictionary: got %q, %q, %v", keys, vals, err)
+	}
+}
+
+func TestCodecMessage(t *testing.T) {
+	call := &pb.ProcedureCall{Service: "SpaceCenter", Procedure: "get_UT"}
+	b, err := krpc.EncodeMessage(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := pb.ProcedureCall{}
+	if err := krpc.DecodeMessage(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetService() != call.Service || got.GetProcedure() != call.Procedure {
+		t.Errorf("got %v, want %v", &got, call)
+	}
+}
+
+func TestCodecTruncated(t *testing.T) {
+	b := krpc.EncodeString("Kerbal X")
+	if _, err := krpc.DecodeString(b[:len(b)-1]); err == nil {
+		t.Errorf("truncated string decoded")
+	}
+	if _, err := krpc.DecodeFloat64(bytes.Repeat([]byte{0}, 4)); err == nil {
+		t.Errorf("truncated double decoded")
+	}
+}
@@ -1,8 +1,10 @@
 package krpc
 
 import (
-	"log"
+	"context"
 	"net"
+	"strings"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 
@@ -10,54 +12,151 @@ import (
 )
 
 type Conn struct {
-	id   []byte
-	conn net.Conn
+	// maxSize is read by the reader goroutine while SetMaxMessageSize may
+	// change it, so it is accessed atomically and kept first for alignment.
+	maxSize uint64
+
+	id     []byte
+	conn   net.Conn
+	frames framer
+	log    Logger
+	trace  bool
+	rec    *Recorder
+	// kind is "rpc" or "stream", for recording.
+	kind string
+
+	calls callQueue
+
+	// The address and options of the connection, and how to open it again,
+	// for reconnecting.
+	addr   string
+	opts   options
+	redial func(ctx context.Context) (*Conn, error)
+
+	// closed is set when Close is called, and guarded by calls.mu.
+	closed      bool
+	closing     chan struct{}
+	onReconnect func(err error)
 }
 
+// ID returns the client identifier assigned by the server. It changes when
+// the connection reconnects.
 func (c *Conn) ID() []byte {
+	c.calls.mu.Lock()
+	defer c.calls.mu.Unlock()
+
 	return c.id
 }
 
 func (c *Conn) Close() error {
-	return c.conn.Close()
+	c.calls.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.closing)
+	}
+	conn := c.conn
+	c.calls.mu.Unlock()
+
+	return conn.Close()
 }
 
-func Connect(addr string) (*Conn, error) {
-	// Open connection.
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
+func Connect(addr string, opts ...Option) (*Conn, error) {
+	return ConnectContext(context.Background(), addr, opts...)
+}
+
+// ConnectContext is like Connect, but gives up on connecting and performing
+// the handshake when ctx is done.
+func ConnectContext(ctx context.Context, addr string, opts ...Option) (*Conn, error) {
+	o := newOptions(opts)
+	return connect(ctx, addr, pb.ConnectionRequest{
+		Type:             pb.ConnectionRequest_RPC,
+		ClientName:       o.clientName,
+		ClientIdentifier: []byte{},
+	}, o.conn, o)
+}
+
+// connect opens a connection to addr and performs the kRPC handshake using
+// req. The RPC and stream servers share the same handshake, differing only in
+// the request type and client identifier. If conn is not nil, the handshake is
+// performed over it instead of a new connection.
+func connect(ctx context.Context, addr string, req pb.ConnectionRequest, conn net.Conn, o options) (*Conn, error) {
+	if o.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.dialTimeout)
+		defer cancel()
 	}
 
-	// Construct connection.
-	c := Conn{
-		conn: conn,
+	// Open connection. Only connections dialed here can be dialed again to
+	// reconnect.
+	dialed := conn == nil
+	if dialed {
+		var err error
+		conn, err = o.dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Make connection request.
-	req := pb.ConnectionRequest{
-		Type:             pb.ConnectionRequest_RPC,
-		ClientName:       "jeb",
-		ClientIdentifier: []byte{},
+	// Construct connection.
+	c := newConn(conn, newVarintFramer(conn), addr, o)
+	if dialed {
+		c.redial = func(ctx context.Context) (*Conn, error) {
+			return connect(ctx, addr, req, nil, o)
+		}
 	}
-	_, err = c.Send(&req)
+	err := c.handshake(ctx, req)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	return c, nil
+}
+
+// handshake sends the connection request req and reads the server's
+// response.
+func (c *Conn) handshake(ctx context.Context, req pb.ConnectionRequest) error {
+	c.kind = strings.ToLower(req.GetType().String())
+	stop := watchContext(ctx, c.conn.SetDeadline)
+	defer stop()
+
+	// Make connection request.
+	_, err := c.Send(&req)
+	if err != nil {
+		return contextError(ctx, err)
+	}
 
 	// Read connection response.
 	res := pb.ConnectionResponse{}
 	err = c.Read(&res)
 	if err != nil {
-		return nil, err
+		return contextError(ctx, err)
 	}
 
 	// Parse connection response.
 	if res.GetStatus() != pb.ConnectionResponse_OK {
-		log.Println("bad connection response")
-		return nil, errors.Errorf("bad connection response: %#s", res.GetMessage())
+		c.log.Log(LevelError, "bad connection response",
+			Field{"addr", c.addr}, Field{"status", res.GetStatus()}, Field{"message", res.GetMessage()})
+		return errors.Errorf("bad connection response: %s: %s", res.GetStatus(), res.GetMessage())
 	}
 	c.id = res.GetClientIdentifier()
+	c.log.Log(LevelInfo, "connected", Field{"addr", c.addr}, Field{"type", req.GetType()})
 
-	return &c, nil
+	return nil
+}
+
+// newConn returns a connection that exchanges messages over conn using
+// frames.
+func newConn(conn net.Conn, frames framer, addr string, o options) *Conn {
+	c := &Conn{
+		conn:    conn,
+		frames:  frames,
+		log:     o.logger,
+		trace:   o.trace,
+		rec:     o.recorder,
+		addr:    addr,
+		opts:    o,
+		closing: make(chan struct{}),
+	}
+	atomic.StoreUint64(&c.maxSize, o.maxSize)
+	return c
 }
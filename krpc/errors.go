@@ -0,0 +1,83 @@
+package krpc
+
+import (
+	"sync"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// Exception is an exception thrown by a procedure on the server. Exceptions
+// declared by a service are returned as their own error types, which embed
+// Exception; other exceptions are returned as *Exception.
+type Exception struct {
+	Service     string
+	Name        string
+	Description string
+	StackTrace  string
+}
+
+func (e *Exception) Error() string {
+	if e.Name == "" {
+		return e.Description
+	}
+	return e.Service + "." + e.Name + ": " + e.Description
+}
+
+var (
+	exceptionsMu sync.RWMutex
+	exceptions   = make(map[string]func(Exception) error)
+)
+
+// RegisterException registers the constructor of the error type for an
+// exception declared by a service. Generated services register their
+// exceptions when the package is initialized.
+func RegisterException(service, name string, fn func(Exception) error) {
+	exceptionsMu.Lock()
+	defer exceptionsMu.Unlock()
+
+	exceptions[service+"."+name] = fn
+}
+
+// newError converts an error returned by the server into the error type
+// registered for its exception.
+func newError(e *pb.Error) error {
+	err := Exception{
+		Service:     e.GetService(),
+		Name:        e.GetName(),
+		Description: e.GetDescription(),
+		StackTrace:  e.GetStackTrace(),
+	}
+
+	exceptionsMu.RLock()
+	fn, ok := exceptions[err.Service+"."+err.Name]
+	exceptionsMu.RUnlock()
+
+	if !ok {
+		return &err
+	}
+	return fn(err)
+}
+
+// Exceptions declared by the KRPC service.
+
+// InvalidOperationException is thrown when a procedure is called in an
+// invalid state, such as controlling a vessel that is not active.
+type InvalidOperationException struct{ Exception }
+
+// ArgumentException is thrown when a procedure argument is invalid.
+type ArgumentException struct{ Exception }
+
+// ArgumentNullException is thrown when a null argument is passed to a
+// procedure that does not accept one.
+type ArgumentNullException struct{ Exception }
+
+// ArgumentOutOfRangeException is thrown when a procedure argument is outside
+// its valid range.
+type ArgumentOutOfRangeException struct{ Exception }
+
+func init() {
+	RegisterException("KRPC", "InvalidOperationException", func(e Exception) error { return &InvalidOperationException{e} })
+	RegisterException("KRPC", "ArgumentException", func(e Exception) error { return &ArgumentException{e} })
+	RegisterException("KRPC", "ArgumentNullException", func(e Exception) error { return &ArgumentNullException{e} })
+	RegisterException("KRPC", "ArgumentOutOfRangeException", func(e Exception) error { return &ArgumentOutOfRangeException{e} })
+}
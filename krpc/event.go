@@ -0,0 +1,96 @@
+package krpc
+
+import (
+	"context"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// Event is a server-side event that fires whenever its expression becomes
+// true. Its stream is not started until Start or Wait is called. Events are
+// not re-added after reconnecting, and end with a SessionLostError instead.
+type Event struct {
+	*Stream
+
+	fired chan struct{}
+}
+
+// AddEvent registers an event that fires when expr evaluates to true.
+func (k *KRPC) AddEvent(expr *Expression) (*Event, error) {
+	return k.AddEventContext(context.Background(), expr)
+}
+
+// AddEventContext is like AddEvent, but gives up waiting for the server when
+// ctx is done.
+func (k *KRPC) AddEventContext(ctx context.Context, expr *Expression) (*Event, error) {
+	if k.stream == nil {
+		return nil, ErrNoStreamClient
+	}
+
+	eventBytes, err := k.conn.Invoke(ctx, &pb.ProcedureCall{
+		Service:   "KRPC",
+		Procedure: "AddEvent",
+		Arguments: []*pb.Argument{
+			&pb.Argument{Position: 0, Value: EncodeObject(expr.id)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	event := pb.Event{}
+	err = DecodeMessage(eventBytes, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newStream(k, event.GetStream().GetId())
+	k.stream.Subscribe(s.id, s.handle)
+	k.stream.track(s)
+
+	e := Event{
+		Stream: s,
+		fired:  make(chan struct{}, 1),
+	}
+	s.listen(func(value []byte) {
+		v, err := DecodeBool(value)
+		if err != nil || !v {
+			return
+		}
+		select {
+		case e.fired <- struct{}{}:
+		default:
+		}
+	}, func() { close(e.fired) })
+
+	return &e, nil
+}
+
+// Fired returns a channel that receives a value each time the event fires. It
+// is closed when the event is removed or its session is lost. The event must
+// be started for it to fire.
+func (e *Event) Fired() <-chan struct{} {
+	return e.fired
+}
+
+// Wait starts the event if necessary and blocks until it fires, ctx is done,
+// or the event ends. It returns ErrStreamClosed if the event has been removed
+// or the stream connection closes, and a SessionLostError if its session has
+// been lost.
+func (e *Event) Wait(ctx context.Context) error {
+	err := e.Start()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case _, ok := <-e.fired:
+		if !ok {
+			return e.closedErr()
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.k.stream.Done():
+		return ErrStreamClosed
+	}
+}
@@ -0,0 +1,286 @@
+package krpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// ErrNilExpression is returned when building an expression from a nil
+// expression or type.
+var ErrNilExpression = errors.New("nil expression or type")
+
+// Expression is a server-side expression tree, built with the static methods
+// of KRPC.Expression and evaluated by the server, for example to trigger an
+// Event.
+type Expression struct {
+	conn *Conn
+	id   uint64
+}
+
+// Type is a server-side type, used to cast expressions.
+type Type struct {
+	conn *Conn
+	id   uint64
+}
+
+// ExpressionStatic has the static methods of the KRPC.Expression class. Each
+// has a Context variant, which gives up waiting for the server when ctx is
+// done. They return ErrNilExpression if given a nil expression or type.
+type ExpressionStatic struct {
+	conn *Conn
+}
+
+// TypeStatic has the static methods of the KRPC.Type class. Each has a
+// Context variant, which gives up waiting for the server when ctx is done.
+type TypeStatic struct {
+	conn *Conn
+}
+
+// Expression returns the static methods of the KRPC.Expression class.
+func (k *KRPC) Expression() *ExpressionStatic {
+	return &ExpressionStatic{conn: k.conn}
+}
+
+// Type returns the static methods of the KRPC.Type class.
+func (k *KRPC) Type() *TypeStatic {
+	return &TypeStatic{conn: k.conn}
+}
+
+func (static *ExpressionStatic) ConstantDouble(value float64) (*Expression, error) {
+	return static.ConstantDoubleContext(context.Background(), value)
+}
+
+func (static *ExpressionStatic) ConstantDoubleContext(ctx context.Context, value float64) (*Expression, error) {
+	return static.call(ctx, "ConstantDouble", EncodeFloat64(value))
+}
+
+func (static *ExpressionStatic) ConstantFloat(value float32) (*Expression, error) {
+	return static.ConstantFloatContext(context.Background(), value)
+}
+
+func (static *ExpressionStatic) ConstantFloatContext(ctx context.Context, value float32) (*Expression, error) {
+	return static.call(ctx, "ConstantFloat", EncodeFloat32(value))
+}
+
+func (static *ExpressionStatic) ConstantInt(value int32) (*Expression, error) {
+	return static.ConstantIntContext(context.Background(), value)
+}
+
+func (static *ExpressionStatic) ConstantIntContext(ctx context.Context, value int32) (*Expression, error) {
+	return static.call(ctx, "ConstantInt", EncodeInt32(value))
+}
+
+func (static *ExpressionStatic) ConstantBool(value bool) (*Expression, error) {
+	return static.ConstantBoolContext(context.Background(), value)
+}
+
+func (static *ExpressionStatic) ConstantBoolContext(ctx context.Context, value bool) (*Expression, error) {
+	return static.call(ctx, "ConstantBool", EncodeBool(value))
+}
+
+func (static *ExpressionStatic) ConstantString(value string) (*Expression, error) {
+	return static.ConstantStringContext(context.Background(), value)
+}
+
+func (static *ExpressionStatic) ConstantStringContext(ctx context.Context, value string) (*Expression, error) {
+	return static.call(ctx, "ConstantString", EncodeString(value))
+}
+
+// Call returns an expression that evaluates to the result of call, such as
+// the procedure call returned by Flight.SurfaceAltitudeCall.
+func (static *ExpressionStatic) Call(call *pb.ProcedureCall) (*Expression, error) {
+	return static.CallContext(context.Background(), call)
+}
+
+func (static *ExpressionStatic) CallContext(ctx context.Context, call *pb.ProcedureCall) (*Expression, error) {
+	callBytes, err := EncodeMessage(call)
+	if err != nil {
+		return nil, err
+	}
+	return static.call(ctx, "Call", callBytes)
+}
+
+func (static *ExpressionStatic) Equal(arg0, arg1 *Expression) (*Expression, error) {
+	return static.EqualContext(context.Background(), arg0, arg1)
+}
+
+func (static *ExpressionStatic) EqualContext(ctx context.Context, arg0, arg1 *Expression) (*Expression, error) {
+	return static.binary(ctx, "Equal", arg0, arg1)
+}
+
+func (static *ExpressionStatic) NotEqual(arg0, arg1 *Expression) (*Expression, error) {
+	return static.NotEqualContext(context.Background(), arg0, arg1)
+}
+
+func (static *ExpressionStatic) NotEqualContext(ctx context.Context, arg0, arg1 *Expression) (*Expression, error) {
+	return static.binary(ctx, "NotEqual", arg0, arg1)
+}
+
+func (static *ExpressionStatic) GreaterThan(arg0, arg1 *Expression) (*Expression, error) {
+	return static.GreaterThanContext(context.Background(), arg0, arg1)
+}
+
+func (static *ExpressionStatic) GreaterThanContext(ctx context.Context, arg0, arg1 *Expression) (*Expression, error) {
+	return static.binary(ctx, "GreaterThan", arg0, arg1)
+}
+
+func (static *ExpressionStatic) GreaterThanOrEqual(arg0, arg1 *Expression) (*Expression, error) {
+	return static.GreaterThanOrEqualContext(context.Background(), arg0, arg1)
+}
+
+func (static *ExpressionStatic) GreaterThanOrEqualContext(ctx context.Context, arg0, arg1 *Expression) (*Expression, error) {
+	return static.binary(ctx, "GreaterThanOrEqual", arg0, arg1)
+}
+
+func (static *ExpressionStatic) LessThan(arg0, arg1 *Expression) (*Expression, error) {
+	return static.LessThanContext(context.Background(), arg0, arg1)
+}
+
+func (static *ExpressionStatic) LessThanContext(ctx context.Context, arg0, arg1 *Expression) (*Expression, error) {
+	return static.binary(ctx, "LessThan", arg0, arg1)
+}
+
+func (static *ExpressionStatic) LessThanOrEqual(arg0, arg1 *Expression) (*Expression, error) {
+	return static.LessThanOrEqualContext(context.Background(), arg0, arg1)
+}
+
+func (static *ExpressionStatic) LessThanOrEqualContext(ctx context.Context, arg0, arg1 *Expression) (*Expression, error) {
+	return static.binary(ctx, "LessThanOrEqual", arg0, arg1)
+}
+
+func (static *ExpressionStatic) And(arg0, arg1 *Expression) (*Expression, error) {
+	return static.AndContext(context.Background(), arg0, arg1)
+}
+
+func (static *ExpressionStatic) AndContext(ctx context.Context, arg0, arg1 *Expression) (*Expression, error) {
+	return static.binary(ctx, "And", arg0, arg1)
+}
+
+func (static *ExpressionStatic) Or(arg0, arg1 *Expression) (*Expression, error) {
+	return static.OrContext(context.Background(), arg0, arg1)
+}
+
+func (static *ExpressionStatic) OrContext(ctx context.Context, arg0, arg1 *Expression) (*Expression, error) {
+	return static.binary(ctx, "Or", arg0, arg1)
+}
+
+func (static *ExpressionStatic) ExclusiveOr(arg0, arg1 *Expression) (*Expression, error) {
+	return static.ExclusiveOrContext(context.Background(), arg0, arg1)
+}
+
+func (static *ExpressionStatic) ExclusiveOrContext(ctx context.Context, arg0, arg1 *Expression) (*Expression, error) {
+	return static.binary(ctx, "ExclusiveOr", arg0, arg1)
+}
+
+func (static *ExpressionStatic) Not(arg *Expression) (*Expression, error) {
+	return static.NotContext(context.Background(), arg)
+}
+
+func (static *ExpressionStatic) NotContext(ctx context.Context, arg *Expression) (*Expression, error) {
+	if arg == nil {
+		return nil, ErrNilExpression
+	}
+	return static.call(ctx, "Not", EncodeObject(arg.id))
+}
+
+// Cast converts the value of arg to type t, for example to compare a FLOAT
+// procedure result against a double constant.
+func (static *ExpressionStatic) Cast(arg *Expression, t *Type) (*Expression, error) {
+	return static.CastContext(context.Background(), arg, t)
+}
+
+func (static *ExpressionStatic) CastContext(ctx context.Context, arg *Expression, t *Type) (*Expression, error) {
+	if arg == nil || t == nil {
+		return nil, ErrNilExpression
+	}
+	return static.call(ctx, "Cast", EncodeObject(arg.id), EncodeObject(t.id))
+}
+
+// binary calls the binary operator procedure on arg0 and arg1.
+func (static *ExpressionStatic) binary(ctx context.Context, procedure string, arg0, arg1 *Expression) (*Expression, error) {
+	if arg0 == nil || arg1 == nil {
+		return nil, ErrNilExpression
+	}
+	return static.call(ctx, procedure, EncodeObject(arg0.id), EncodeObject(arg1.id))
+}
+
+func (static *ExpressionStatic) call(ctx context.Context, procedure string, args ...[]byte) (*Expression, error) {
+	idBytes, err := static.conn.Invoke(ctx, staticCall("Expression", procedure, args...))
+	if err != nil {
+		return nil, err
+	}
+	id, err := DecodeObject(idBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{conn: static.conn, id: id}, nil
+}
+
+func (static *TypeStatic) Double() (*Type, error) {
+	return static.DoubleContext(context.Background())
+}
+
+func (static *TypeStatic) DoubleContext(ctx context.Context) (*Type, error) {
+	return static.call(ctx, "Double")
+}
+
+func (static *TypeStatic) Float() (*Type, error) {
+	return static.FloatContext(context.Background())
+}
+
+func (static *TypeStatic) FloatContext(ctx context.Context) (*Type, error) {
+	return static.call(ctx, "Float")
+}
+
+func (static *TypeStatic) Int() (*Type, error) {
+	return static.IntContext(context.Background())
+}
+
+func (static *TypeStatic) IntContext(ctx context.Context) (*Type, error) {
+	return static.call(ctx, "Int")
+}
+
+func (static *TypeStatic) Bool() (*Type, error) {
+	return static.BoolContext(context.Background())
+}
+
+func (static *TypeStatic) BoolContext(ctx context.Context) (*Type, error) {
+	return static.call(ctx, "Bool")
+}
+
+func (static *TypeStatic) String() (*Type, error) {
+	return static.StringContext(context.Background())
+}
+
+func (static *TypeStatic) StringContext(ctx context.Context) (*Type, error) {
+	return static.call(ctx, "String")
+}
+
+func (static *TypeStatic) call(ctx context.Context, procedure string) (*Type, error) {
+	idBytes, err := static.conn.Invoke(ctx, staticCall("Type", procedure))
+	if err != nil {
+		return nil, err
+	}
+	id, err := DecodeObject(idBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &Type{conn: static.conn, id: id}, nil
+}
+
+// staticCall builds a call to a static method of a KRPC service class.
+func staticCall(class, method string, args ...[]byte) *pb.ProcedureCall {
+	call := pb.ProcedureCall{
+		Service:   "KRPC",
+		Procedure: class + "_static_" + method,
+	}
+	for i, arg := range args {
+		call.Arguments = append(call.Arguments, &pb.Argument{
+			Position: uint32(i),
+			Value:    arg,
+		})
+	}
+	return &call
+}
@@ -0,0 +1,599 @@
+package krpc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// Object is a remote object returned by Client.Invoke, which can be passed
+// back to it as an argument. Object ID 0 represents null.
+type Object struct {
+	Service, Class string
+	ID             uint64
+}
+
+// Enum is an enumeration value returned by Client.Invoke. Enumeration
+// arguments may be given as an Enum, an int32, or the name of the value.
+type Enum struct {
+	Service, Enumeration string
+	// Name is the name of the value, or empty if the server returned an
+	// undeclared value.
+	Name  string
+	Value int32
+}
+
+// Value is the return value of a procedure called with Client.Invoke.
+type Value struct {
+	// Type is the type of the value, or nil if the procedure returns nothing.
+	Type *pb.Type
+	// Raw is the encoded value.
+	Raw []byte
+
+	v interface{}
+}
+
+// Interface returns the decoded value: a float64, float32, int32, int64,
+// uint32, uint64, bool, string or []byte for scalars; an Object or Enum;
+// []interface{} for tuples, lists and sets; map[interface{}]interface{} for
+// dictionaries; and protobuf messages for the KRPC service's message types.
+// Null values are returned as nil. Dictionaries can only be decoded if their
+// keys are scalars other than bytes, objects or enumeration values.
+func (v Value) Interface() interface{} {
+	return v.v
+}
+
+// schema caches the procedures and enumerations of the server's services.
+type schema struct {
+	mu           sync.Mutex
+	procedures   map[string]*pb.Procedure
+	enumerations map[string]*pb.Enumeration
+}
+
+// reset forgets the cached services, which may have changed if the client
+// has reconnected to a restarted server.
+func (s *schema) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.procedures = nil
+	s.enumerations = nil
+}
+
+// Invoke calls service.procedure with args, encoding them according to the
+// procedure's parameter types, and decodes its return value. The types are
+// looked up from the server's services, which are fetched on the first call
+// and cached until the client reconnects. Trailing parameters with default
+// values may be omitted.
+//
+// Arguments are converted as described for Value.Interface, except that any
+// Go number type can be given for a number parameter, a uint64 ID can be
+// given for an object, and a Point, Vector, Quaternion or BoundingBox can be
+// given for a tuple of the same shape.
+func (c *Client) Invoke(ctx context.Context, service, procedure string, args ...interface{}) (Value, error) {
+	proc, err := c.procedure(ctx, service, procedure)
+	if err != nil {
+		return Value{}, err
+	}
+
+	params := proc.GetParameters()
+	if len(args) > len(params) {
+		return Value{}, errors.Errorf("%s.%s takes %d arguments, got %d", service, procedure, len(params), len(args))
+	}
+	for _, param := range params[len(args):] {
+		if param.GetDefaultValue() == nil {
+			return Value{}, errors.Errorf("%s.%s: missing argument %s", service, procedure, param.GetName())
+		}
+	}
+
+	call := pb.ProcedureCall{
+		Service:   service,
+		Procedure: procedure,
+	}
+	for i, arg := range args {
+		param := params[i]
+		var value []byte
+		// Null objects are sent as object ID 0, other null values as no
+		// bytes.
+		if arg != nil || !param.GetNullable() || param.GetType().GetCode() == pb.Type_CLASS {
+			value, err = c.encodeValue(param.GetType(), arg)
+			if err != nil {
+				return Value{}, errors.Wrapf(err, "%s.%s: argument %s", service, procedure, param.GetName())
+			}
+		}
+		call.Arguments = append(call.Arguments, &pb.Argument{Position: uint32(i), Value: value})
+	}
+
+	result, err := c.conn.Invoke(ctx, &call)
+	if err != nil {
+		return Value{}, err
+	}
+	t := proc.GetReturnType()
+	if t == nil || t.GetCode() == pb.Type_NONE {
+		return Value{Raw: result}, nil
+	}
+	if len(result) == 0 && proc.GetReturnIsNullable() {
+		return Value{Type: t, Raw: result}, nil
+	}
+	v, err := c.decodeValue(t, result)
+	if err != nil {
+		return Value{}, errors.Wrapf(err, "%s.%s: return value", service, procedure)
+	}
+	return Value{Type: t, Raw: result, v: v}, nil
+}
+
+// procedure looks up a procedure, fetching the server's services if they
+// have not been cached.
+func (c *Client) procedure(ctx context.Context, service, procedure string) (*pb.Procedure, error) {
+	procedures, err := c.loadSchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+	proc, ok := procedures[service+"."+procedure]
+	if !ok {
+		return nil, errors.Errorf("no procedure %s.%s", service, procedure)
+	}
+	return proc, nil
+}
+
+// loadSchema returns the cached procedures, fetching the server's services if
+// they have not been cached.
+func (c *Client) loadSchema(ctx context.Context) (map[string]*pb.Procedure, error) {
+	c.schema.mu.Lock()
+	defer c.schema.mu.Unlock()
+
+	if c.schema.procedures != nil {
+		return c.schema.procedures, nil
+	}
+	services, err := c.KRPC.GetServicesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	procedures := make(map[string]*pb.Procedure)
+	enumerations := make(map[string]*pb.Enumeration)
+	for _, s := range services.GetServices() {
+		for _, p := range s.GetProcedures() {
+			procedures[s.GetName()+"."+p.GetName()] = p
+		}
+		for _, e := range s.GetEnumerations() {
+			enumerations[s.GetName()+"."+e.GetName()] = e
+		}
+	}
+	c.schema.procedures = procedures
+	c.schema.enumerations = enumerations
+	return procedures, nil
+}
+
+// encodeValue encodes v as a value of type t.
+func (c *Client) encodeValue(t *pb.Type, v interface{}) ([]byte, error) {
+	switch t.GetCode() {
+	case pb.Type_DOUBLE:
+		f, ok := toFloat64(v)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		return EncodeFloat64(f), nil
+	case pb.Type_FLOAT:
+		f, ok := toFloat64(v)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		return EncodeFloat32(float32(f)), nil
+	case pb.Type_SINT32:
+		i, ok := toInt64(v)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, rangeError(t, v)
+		}
+		return EncodeInt32(int32(i)), nil
+	case pb.Type_SINT64:
+		i, ok := toInt64(v)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		return EncodeInt64(i), nil
+	case pb.Type_UINT32:
+		i, ok := toInt64(v)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		if i < 0 || i > math.MaxUint32 {
+			return nil, rangeError(t, v)
+		}
+		return EncodeUint32(uint32(i)), nil
+	case pb.Type_UINT64:
+		switch u := v.(type) {
+		case uint64:
+			return EncodeUint64(u), nil
+		case uint:
+			return EncodeUint64(uint64(u)), nil
+		}
+		i, ok := toInt64(v)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		if i < 0 {
+			return nil, rangeError(t, v)
+		}
+		return EncodeUint64(uint64(i)), nil
+	case pb.Type_BOOL:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		return EncodeBool(b), nil
+	case pb.Type_STRING:
+		s, ok := v.(string)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		return EncodeString(s), nil
+	case pb.Type_BYTES:
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		return EncodeBytes(b), nil
+
+	case pb.Type_CLASS:
+		switch o := v.(type) {
+		case nil:
+			return EncodeObject(0), nil
+		case Object:
+			if o.ID != 0 && (o.Service != t.GetService() || o.Class != t.GetName()) {
+				return nil, typeError(t, v)
+			}
+			return EncodeObject(o.ID), nil
+		case uint64:
+			return EncodeObject(o), nil
+		}
+		return nil, typeError(t, v)
+	case pb.Type_ENUMERATION:
+		switch e := v.(type) {
+		case Enum:
+			if e.Service != t.GetService() || e.Enumeration != t.GetName() {
+				return nil, typeError(t, v)
+			}
+			return EncodeEnum(e.Value), nil
+		case string:
+			value, ok := c.enumValue(t, e)
+			if !ok {
+				return nil, errors.Errorf("%s.%s has no value %s", t.GetService(), t.GetName(), e)
+			}
+			return EncodeEnum(value), nil
+		}
+		i, ok := toInt64(v)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, rangeError(t, v)
+		}
+		return EncodeEnum(int32(i)), nil
+
+	case pb.Type_TUPLE:
+		items, ok := tupleItems(v)
+		if !ok || len(items) != len(t.GetTypes()) {
+			return nil, typeError(t, v)
+		}
+		encoded, err := c.encodeItems(t.GetTypes(), items)
+		if err != nil {
+			return nil, err
+		}
+		return EncodeTuple(encoded...), nil
+	case pb.Type_LIST, pb.Type_SET:
+		items, ok := v.([]interface{})
+		if !ok || len(t.GetTypes()) != 1 {
+			return nil, typeError(t, v)
+		}
+		types := make([]*pb.Type, len(items))
+		for i := range types {
+			types[i] = t.GetTypes()[0]
+		}
+		encoded, err := c.encodeItems(types, items)
+		if err != nil {
+			return nil, err
+		}
+		if t.GetCode() == pb.Type_SET {
+			return EncodeSet(encoded), nil
+		}
+		return EncodeList(encoded), nil
+	case pb.Type_DICTIONARY:
+		if len(t.GetTypes()) != 2 {
+			return nil, typeError(t, v)
+		}
+		var keys, values [][]byte
+		add := func(key, value interface{}) error {
+			k, err := c.encodeValue(t.GetTypes()[0], key)
+			if err != nil {
+				return err
+			}
+			v, err := c.encodeValue(t.GetTypes()[1], value)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+			values = append(values, v)
+			return nil
+		}
+		switch m := v.(type) {
+		case map[interface{}]interface{}:
+			for key, value := range m {
+				if err := add(key, value); err != nil {
+					return nil, err
+				}
+			}
+		case map[string]interface{}:
+			for key, value := range m {
+				if err := add(key, value); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, typeError(t, v)
+		}
+		return EncodeDictionary(keys, values), nil
+
+	case pb.Type_PROCEDURE_CALL:
+		call, ok := v.(*pb.ProcedureCall)
+		if !ok {
+			return nil, typeError(t, v)
+		}
+		return EncodeMessage(call)
+	}
+	return nil, errors.Errorf("unsupported parameter type %s", t.GetCode())
+}
+
+func (c *Client) encodeItems(types []*pb.Type, items []interface{}) ([][]byte, error) {
+	encoded := make([][]byte, len(items))
+	for i, item := range items {
+		var err error
+		encoded[i], err = c.encodeValue(types[i], item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "item %d", i)
+		}
+	}
+	return encoded, nil
+}
+
+// decodeValue decodes a value of type t.
+func (c *Client) decodeValue(t *pb.Type, b []byte) (interface{}, error) {
+	switch t.GetCode() {
+	case pb.Type_DOUBLE:
+		return DecodeFloat64(b)
+	case pb.Type_FLOAT:
+		return DecodeFloat32(b)
+	case pb.Type_SINT32:
+		return DecodeInt32(b)
+	case pb.Type_SINT64:
+		return DecodeInt64(b)
+	case pb.Type_UINT32:
+		return DecodeUint32(b)
+	case pb.Type_UINT64:
+		return DecodeUint64(b)
+	case pb.Type_BOOL:
+		return DecodeBool(b)
+	case pb.Type_STRING:
+		return DecodeString(b)
+	case pb.Type_BYTES:
+		return DecodeBytes(b)
+
+	case pb.Type_CLASS:
+		id, err := DecodeObject(b)
+		if err != nil {
+			return nil, err
+		}
+		if id == 0 {
+			return nil, nil
+		}
+		return Object{Service: t.GetService(), Class: t.GetName(), ID: id}, nil
+	case pb.Type_ENUMERATION:
+		value, err := DecodeEnum(b)
+		if err != nil {
+			return nil, err
+		}
+		e := Enum{Service: t.GetService(), Enumeration: t.GetName(), Value: value}
+		e.Name, _ = c.enumName(t, value)
+		return e, nil
+
+	case pb.Type_TUPLE:
+		items, err := DecodeTuple(b, len(t.GetTypes()))
+		if err != nil {
+			return nil, err
+		}
+		return c.decodeItems(t.GetTypes(), items)
+	case pb.Type_LIST, pb.Type_SET:
+		if len(t.GetTypes()) != 1 {
+			return nil, errors.Errorf("%s has %d element types", t.GetCode(), len(t.GetTypes()))
+		}
+		decode := DecodeList
+		if t.GetCode() == pb.Type_SET {
+			decode = DecodeSet
+		}
+		items, err := decode(b)
+		if err != nil {
+			return nil, err
+		}
+		types := make([]*pb.Type, len(items))
+		for i := range types {
+			types[i] = t.GetTypes()[0]
+		}
+		return c.decodeItems(types, items)
+	case pb.Type_DICTIONARY:
+		if len(t.GetTypes()) != 2 {
+			return nil, errors.Errorf("DICTIONARY has %d element types", len(t.GetTypes()))
+		}
+		if !hashable(t.GetTypes()[0]) {
+			return nil, errors.Errorf("unsupported DICTIONARY with %s keys", t.GetTypes()[0].GetCode())
+		}
+		keys, values, err := DecodeDictionary(b)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[interface{}]interface{}, len(keys))
+		for i := range keys {
+			key, err := c.decodeValue(t.GetTypes()[0], keys[i])
+			if err != nil {
+				return nil, err
+			}
+			value, err := c.decodeValue(t.GetTypes()[1], values[i])
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+
+	case pb.Type_PROCEDURE_CALL:
+		msg := pb.ProcedureCall{}
+		return &msg, DecodeMessage(b, &msg)
+	case pb.Type_STREAM:
+		msg := pb.Stream{}
+		return &msg, DecodeMessage(b, &msg)
+	case pb.Type_EVENT:
+		msg := pb.Event{}
+		return &msg, DecodeMessage(b, &msg)
+	case pb.Type_STATUS:
+		msg := pb.Status{}
+		return &msg, DecodeMessage(b, &msg)
+	case pb.Type_SERVICES:
+		msg := pb.Services{}
+		return &msg, DecodeMessage(b, &msg)
+	}
+	return nil, errors.Errorf("unsupported return type %s", t.GetCode())
+}
+
+// hashable reports whether decoded values of t can be used as map keys.
+// Tuples, lists and sets decode to slices, which cannot.
+func hashable(t *pb.Type) bool {
+	switch t.GetCode() {
+	case pb.Type_DOUBLE, pb.Type_FLOAT, pb.Type_SINT32, pb.Type_SINT64, pb.Type_UINT32, pb.Type_UINT64,
+		pb.Type_BOOL, pb.Type_STRING, pb.Type_CLASS, pb.Type_ENUMERATION:
+		return true
+	}
+	return false
+}
+
+func (c *Client) decodeItems(types []*pb.Type, items [][]byte) ([]interface{}, error) {
+	decoded := make([]interface{}, len(items))
+	for i, item := range items {
+		var err error
+		decoded[i], err = c.decodeValue(types[i], item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "item %d", i)
+		}
+	}
+	return decoded, nil
+}
+
+func (c *Client) enumValue(t *pb.Type, name string) (int32, bool) {
+	c.schema.mu.Lock()
+	e := c.schema.enumerations[t.GetService()+"."+t.GetName()]
+	c.schema.mu.Unlock()
+
+	for _, v := range e.GetValues() {
+		if v.GetName() == name {
+			return v.GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func (c *Client) enumName(t *pb.Type, value int32) (string, bool) {
+	c.schema.mu.Lock()
+	e := c.schema.enumerations[t.GetService()+"."+t.GetName()]
+	c.schema.mu.Unlock()
+
+	for _, v := range e.GetValues() {
+		if v.GetValue() == value {
+			return v.GetName(), true
+		}
+	}
+	return "", false
+}
+
+// tupleItems returns the items of a tuple argument.
+func tupleItems(v interface{}) ([]interface{}, bool) {
+	switch t := v.(type) {
+	case []interface{}:
+		return t, true
+	case Point:
+		return []interface{}{t.X, t.Y}, true
+	case Vector:
+		return []interface{}{t.X, t.Y, t.Z}, true
+	case Quaternion:
+		return []interface{}{t.A, t.B, t.C, t.D}, true
+	case BoundingBox:
+		return []interface{}{
+			[]interface{}{t.Min.X, t.Min.Y, t.Min.Z},
+			[]interface{}{t.Max.X, t.Max.Y, t.Max.Z},
+		}, true
+	}
+	return nil, false
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	}
+	i, ok := toInt64(v)
+	return float64(i), ok
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		if uint64(n) <= math.MaxInt64 {
+			return int64(n), true
+		}
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		if n <= math.MaxInt64 {
+			return int64(n), true
+		}
+	case float64:
+		// Accept whole floats, such as numbers decoded from JSON.
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+func typeError(t *pb.Type, v interface{}) error {
+	name := t.GetCode().String()
+	if t.GetName() != "" {
+		name = t.GetService() + "." + t.GetName()
+	}
+	return fmt.Errorf("cannot use %T as %s", v, name)
+}
+
+func rangeError(t *pb.Type, v interface{}) error {
+	return fmt.Errorf("%v out of range for %s", v, t.GetCode())
+}
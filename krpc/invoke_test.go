@@ -0,0 +1,161 @@
+package krpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ilikebits/jeb/krpc"
+	"github.com/ilikebits/jeb/krpc/krpctest"
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+func TestInvoke(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	vessel := &pb.Type{Code: pb.Type_CLASS, Service: "Test", Name: "Vessel"}
+	situation := &pb.Type{Code: pb.Type_ENUMERATION, Service: "Test", Name: "Situation"}
+	srv.AddService(&pb.Service{
+		Name: "Test",
+		Procedures: []*pb.Procedure{
+			{
+				Name: "Add",
+				Parameters: []*pb.Parameter{
+					{Name: "a", Type: &pb.Type{Code: pb.Type_SINT32}},
+					{Name: "b", Type: &pb.Type{Code: pb.Type_SINT32}, DefaultValue: krpc.EncodeInt32(1)},
+				},
+				ReturnType: &pb.Type{Code: pb.Type_SINT32},
+			},
+			{Name: "get_ActiveVessel", ReturnType: vessel},
+			{
+				Name:       "Vessel_get_Situation",
+				Parameters: []*pb.Parameter{{Name: "this", Type: vessel}},
+				ReturnType: situation,
+			},
+			{
+				Name:       "Target",
+				Parameters: []*pb.Parameter{{Name: "vessel", Type: vessel, Nullable: true}},
+				ReturnType: &pb.Type{Code: pb.Type_BYTES},
+			},
+			{Name: "get_Scores", ReturnType: &pb.Type{Code: pb.Type_DICTIONARY, Types: []*pb.Type{
+				{Code: pb.Type_STRING}, {Code: pb.Type_SINT32},
+			}}},
+			{Name: "get_Positions", ReturnType: &pb.Type{Code: pb.Type_DICTIONARY, Types: []*pb.Type{
+				{Code: pb.Type_TUPLE, Types: []*pb.Type{{Code: pb.Type_SINT32}, {Code: pb.Type_SINT32}}},
+				{Code: pb.Type_STRING},
+			}}},
+		},
+		Classes:      []*pb.Class{{Name: "Vessel"}},
+		Enumerations: []*pb.Enumeration{{Name: "Situation", Values: []*pb.EnumerationValue{{Name: "Landed", Value: 1}, {Name: "Flying", Value: 2}}}},
+	})
+	srv.HandleFunc("Test", "Add", func(a, b int32) int32 { return a + b })
+	srv.HandleFunc("Test", "get_ActiveVessel", func() uint64 { return 7 })
+	srv.HandleFunc("Test", "Vessel_get_Situation", func(vessel uint64) int32 { return 2 })
+	srv.Handle("Test", "Target", func(call *pb.ProcedureCall) ([]byte, error) {
+		b, err := krpctest.Args(call.GetArguments()).Value(0)
+		return krpc.EncodeBytes(b), err
+	})
+	srv.Handle("Test", "get_Scores", func(*pb.ProcedureCall) ([]byte, error) {
+		return krpc.EncodeDictionary([][]byte{krpc.EncodeString("jeb")}, [][]byte{krpc.EncodeInt32(10)}), nil
+	})
+	srv.Handle("Test", "get_Positions", func(*pb.ProcedureCall) ([]byte, error) {
+		key := krpc.EncodeTuple(krpc.EncodeInt32(1), krpc.EncodeInt32(2))
+		return krpc.EncodeDictionary([][]byte{key}, [][]byte{krpc.EncodeString("jeb")}), nil
+	})
+	c, err := krpc.Dial(srv.Addr, krpc.WithStreamAddr(srv.StreamAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	v, err := c.Invoke(ctx, "Test", "Add", 2, 3)
+	if err != nil || v.Interface() != int32(5) {
+		t.Errorf("Add(2, 3): got %v, %v, want 5", v.Interface(), err)
+	}
+	v, err = c.Invoke(ctx, "Test", "Add", 2)
+	if err != nil || v.Interface() != int32(3) {
+		t.Errorf("Add(2): got %v, %v, want 3", v.Interface(), err)
+	}
+	if _, err := c.Invoke(ctx, "Test", "Add", 1, int64(1)<<40); err == nil {
+		t.Errorf("Add with an out of range argument succeeded")
+	}
+	if _, err := c.Invoke(ctx, "Test", "Add", "x"); err == nil {
+		t.Errorf("Add with a string argument succeeded")
+	}
+	if _, err := c.Invoke(ctx, "Test", "Add"); err == nil {
+		t.Errorf("Add without its required argument succeeded")
+	}
+	if _, err := c.Invoke(ctx, "Test", "Missing"); err == nil {
+		t.Errorf("call of a missing procedure succeeded")
+	}
+
+	v, err = c.Invoke(ctx, "Test", "get_ActiveVessel")
+	want := krpc.Object{Service: "Test", Class: "Vessel", ID: 7}
+	if err != nil || v.Interface() != want {
+		t.Fatalf("get_ActiveVessel: got %v, %v, want %v", v.Interface(), err, want)
+	}
+	v, err = c.Invoke(ctx, "Test", "Vessel_get_Situation", v.Interface())
+	if e, ok := v.Interface().(krpc.Enum); err != nil || !ok || e.Name != "Flying" {
+		t.Errorf("Vessel_get_Situation: got %v, %v, want Flying", v.Interface(), err)
+	}
+
+	// A null object is sent as object ID 0.
+	v, err = c.Invoke(ctx, "Test", "Target", nil)
+	if b, ok := v.Interface().([]byte); err != nil || !ok || string(b) != string(krpc.EncodeObject(0)) {
+		t.Errorf("Target(nil): server got %v, %v, want object 0", v.Interface(), err)
+	}
+
+	v, err = c.Invoke(ctx, "Test", "get_Scores")
+	if m, ok := v.Interface().(map[interface{}]interface{}); err != nil || !ok || len(m) != 1 || m["jeb"] != int32(10) {
+		t.Errorf("get_Scores: got %v, %v, want map[jeb:10]", v.Interface(), err)
+	}
+	// Tuple keys decode to slices, which cannot be map keys.
+	if _, err := c.Invoke(ctx, "Test", "get_Positions"); err == nil {
+		t.Error("get_Positions: decoded a dictionary with tuple keys")
+	}
+}
+
+func TestInvokeReconnect(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	service := func(procedure string) *pb.Service {
+		return &pb.Service{Name: "Test", Procedures: []*pb.Procedure{
+			{Name: procedure, ReturnType: &pb.Type{Code: pb.Type_SINT32}},
+		}}
+	}
+	srv.AddService(service("get_Old"))
+	srv.HandleFunc("Test", "get_Old", func() int32 { return 1 })
+	srv.HandleFunc("Test", "get_New", func() int32 { return 2 })
+	c, err := krpc.Dial(srv.Addr,
+		krpc.WithStreamAddr(srv.StreamAddr),
+		krpc.WithReconnect(krpc.ExponentialBackoff(time.Millisecond, time.Millisecond, 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	if v, err := c.Invoke(ctx, "Test", "get_Old"); err != nil || v.Interface() != int32(1) {
+		t.Fatalf("get_Old: got %v, %v, want 1", v.Interface(), err)
+	}
+
+	// The services are fetched again from the restarted server.
+	srv.AddService(service("get_New"))
+	srv.Disconnect()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v, err := c.Invoke(ctx, "Test", "get_New")
+		if err == nil {
+			if v.Interface() != int32(2) {
+				t.Errorf("get_New: got %v, want 2", v.Interface())
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("get_New: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
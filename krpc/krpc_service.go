@@ -1,43 +1,170 @@
 package krpc
 
 import (
-	"errors"
-
-	"github.com/golang/protobuf/proto"
+	"context"
 
 	"github.com/ilikebits/jeb/krpc/pb"
 )
 
 type KRPC struct {
-	conn *Conn
+	conn   *Conn
+	stream *StreamClient
 }
 
 func (k *KRPC) GetStatus() (pb.Status, error) {
-	req := pb.Request{
-		Calls: []*pb.ProcedureCall{&pb.ProcedureCall{
-			Service:   "KRPC",
-			Procedure: "GetStatus",
-		}},
+	return k.GetStatusContext(context.Background())
+}
+
+// GetStatusContext is like GetStatus, but gives up waiting for the server when
+// ctx is done.
+func (k *KRPC) GetStatusContext(ctx context.Context) (pb.Status, error) {
+	statBytes, err := k.conn.Invoke(ctx, &pb.ProcedureCall{
+		Service:   "KRPC",
+		Procedure: "GetStatus",
+	})
+	if err != nil {
+		return pb.Status{}, err
 	}
-	_, err := k.conn.Send(&req)
+	status := pb.Status{}
+	err = DecodeMessage(statBytes, &status)
 	if err != nil {
 		return pb.Status{}, err
 	}
 
-	res := pb.Response{}
-	err = k.conn.Read(&res)
+	return status, nil
+}
+
+// AddStream registers call as a stream on the server and returns an untyped
+// handle to it. Use the handle's typed accessors, such as Stream.AsFloat64, to
+// decode its values. If start is false, the server will not send updates until
+// Stream.Start is called.
+func (k *KRPC) AddStream(call *pb.ProcedureCall, start bool) (*Stream, error) {
+	return k.AddStreamContext(context.Background(), call, start)
+}
+
+// AddStreamContext is like AddStream, but gives up waiting for the server
+// when ctx is done.
+func (k *KRPC) AddStreamContext(ctx context.Context, call *pb.ProcedureCall, start bool) (*Stream, error) {
+	if k.stream == nil {
+		return nil, ErrNoStreamClient
+	}
+
+	id, err := k.addStream(ctx, call, start)
 	if err != nil {
-		return pb.Status{}, err
+		return nil, err
 	}
-	if e := res.GetError(); e != nil {
-		return pb.Status{}, errors.New(e.GetDescription())
+
+	s := newStream(k, id)
+	s.call = call
+	s.started = start
+	k.stream.Subscribe(id, s.handle)
+	k.stream.track(s)
+	return s, nil
+}
+
+// addStream registers call as a stream and returns its ID.
+func (k *KRPC) addStream(ctx context.Context, call *pb.ProcedureCall, start bool) (uint64, error) {
+	callBytes, err := EncodeMessage(call)
+	if err != nil {
+		return 0, err
 	}
-	statBytes := res.GetResults()[0].GetValue()
-	status := pb.Status{}
-	err = proto.Unmarshal(statBytes, &status)
+	streamBytes, err := k.conn.Invoke(ctx, &pb.ProcedureCall{
+		Service:   "KRPC",
+		Procedure: "AddStream",
+		Arguments: []*pb.Argument{
+			&pb.Argument{Position: 0, Value: callBytes},
+			&pb.Argument{Position: 1, Value: EncodeBool(start)},
+		},
+	})
 	if err != nil {
-		return pb.Status{}, err
+		return 0, err
+	}
+	stream := pb.Stream{}
+	err = DecodeMessage(streamBytes, &stream)
+	if err != nil {
+		return 0, err
 	}
+	return stream.GetId(), nil
+}
 
-	return status, nil
+// StartStream starts a stream that was added with start set to false.
+func (k *KRPC) StartStream(id uint64) error {
+	return k.StartStreamContext(context.Background(), id)
+}
+
+// StartStreamContext is like StartStream, but gives up waiting for the server
+// when ctx is done.
+func (k *KRPC) StartStreamContext(ctx context.Context, id uint64) error {
+	_, err := k.conn.Invoke(ctx, &pb.ProcedureCall{
+		Service:   "KRPC",
+		Procedure: "StartStream",
+		Arguments: []*pb.Argument{
+			&pb.Argument{Position: 0, Value: EncodeUint64(id)},
+		},
+	})
+	return err
+}
+
+// SetStreamRate sets the update rate of a stream in Hz. A rate of zero sends
+// updates as fast as the server can.
+func (k *KRPC) SetStreamRate(id uint64, rate float32) error {
+	return k.SetStreamRateContext(context.Background(), id, rate)
+}
+
+// SetStreamRateContext is like SetStreamRate, but gives up waiting for the server
+// when ctx is done.
+func (k *KRPC) SetStreamRateContext(ctx context.Context, id uint64, rate float32) error {
+	_, err := k.conn.Invoke(ctx, &pb.ProcedureCall{
+		Service:   "KRPC",
+		Procedure: "SetStreamRate",
+		Arguments: []*pb.Argument{
+			&pb.Argument{Position: 0, Value: EncodeUint64(id)},
+			&pb.Argument{Position: 1, Value: EncodeFloat32(rate)},
+		},
+	})
+	return err
+}
+
+// RemoveStream removes a stream from the server. Prefer Stream.Remove, which
+// also stops local delivery of updates.
+func (k *KRPC) RemoveStream(id uint64) error {
+	return k.RemoveStreamContext(context.Background(), id)
+}
+
+// RemoveStreamContext is like RemoveStream, but gives up waiting for the server
+// when ctx is done.
+func (k *KRPC) RemoveStreamContext(ctx context.Context, id uint64) error {
+	_, err := k.conn.Invoke(ctx, &pb.ProcedureCall{
+		Service:   "KRPC",
+		Procedure: "RemoveStream",
+		Arguments: []*pb.Argument{
+			&pb.Argument{Position: 0, Value: EncodeUint64(id)},
+		},
+	})
+	return err
+}
+
+// GetServices returns the services provided by the server, with their
+// procedures, classes, enumerations and exceptions.
+func (k *KRPC) GetServices() (pb.Services, error) {
+	return k.GetServicesContext(context.Background())
+}
+
+// GetServicesContext is like GetServices, but gives up waiting for the server
+// when ctx is done.
+func (k *KRPC) GetServicesContext(ctx context.Context) (pb.Services, error) {
+	servicesBytes, err := k.conn.Invoke(ctx, &pb.ProcedureCall{
+		Service:   "KRPC",
+		Procedure: "GetServices",
+	})
+	if err != nil {
+		return pb.Services{}, err
+	}
+	services := pb.Services{}
+	err = DecodeMessage(servicesBytes, &services)
+	if err != nil {
+		return pb.Services{}, err
+	}
+
+	return services, nil
 }
@@ -0,0 +1,32 @@
+package krpc_test
+
+import (
+	"testing"
+
+	"github.com/ilikebits/jeb/krpc"
+	"github.com/ilikebits/jeb/krpc/krpctest"
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+func TestGetServices(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	srv.AddService(&pb.Service{Name: "Test"})
+	c, err := krpc.Dial(srv.Addr, krpc.WithStreamAddr(srv.StreamAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	services, err := c.KRPC.GetServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range services.GetServices() {
+		names = append(names, s.GetName())
+	}
+	if len(names) != 2 || names[0] != "KRPC" || names[1] != "Test" {
+		t.Errorf("got services %v, want [KRPC Test]", names)
+	}
+}
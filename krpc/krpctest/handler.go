@@ -0,0 +1,293 @@
+package krpctest
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/ilikebits/jeb/krpc"
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// Handler handles a procedure call, returning its encoded return value, or
+// nil if it returns nothing. Returning a *krpc.Exception, or an exception type
+// that embeds one, throws that exception in the client; other errors are
+// thrown as exceptions with only a description.
+type Handler func(call *pb.ProcedureCall) ([]byte, error)
+
+// Args are the arguments of a procedure call, with accessors that decode the
+// argument at a position.
+type Args []*pb.Argument
+
+// Value returns the encoded argument at position pos.
+func (a Args) Value(pos uint32) ([]byte, error) {
+	for _, arg := range a {
+		if arg.GetPosition() == pos {
+			return arg.GetValue(), nil
+		}
+	}
+	return nil, &krpc.Exception{
+		Service:     "KRPC",
+		Name:        "ArgumentException",
+		Description: fmt.Sprintf("Missing argument at position %d", pos),
+	}
+}
+
+func (a Args) Float64(pos uint32) (float64, error) {
+	b, err := a.Value(pos)
+	if err != nil {
+		return 0, err
+	}
+	return krpc.DecodeFloat64(b)
+}
+
+func (a Args) Float32(pos uint32) (float32, error) {
+	b, err := a.Value(pos)
+	if err != nil {
+		return 0, err
+	}
+	return krpc.DecodeFloat32(b)
+}
+
+func (a Args) Int32(pos uint32) (int32, error) {
+	b, err := a.Value(pos)
+	if err != nil {
+		return 0, err
+	}
+	return krpc.DecodeInt32(b)
+}
+
+func (a Args) Uint64(pos uint32) (uint64, error) {
+	b, err := a.Value(pos)
+	if err != nil {
+		return 0, err
+	}
+	return krpc.DecodeUint64(b)
+}
+
+func (a Args) Bool(pos uint32) (bool, error) {
+	b, err := a.Value(pos)
+	if err != nil {
+		return false, err
+	}
+	return krpc.DecodeBool(b)
+}
+
+func (a Args) String(pos uint32) (string, error) {
+	b, err := a.Value(pos)
+	if err != nil {
+		return "", err
+	}
+	return krpc.DecodeString(b)
+}
+
+// Object returns the ID of the remote object at position pos.
+func (a Args) Object(pos uint32) (uint64, error) {
+	b, err := a.Value(pos)
+	if err != nil {
+		return 0, err
+	}
+	return krpc.DecodeObject(b)
+}
+
+func (a Args) Message(pos uint32, msg proto.Message) error {
+	b, err := a.Value(pos)
+	if err != nil {
+		return err
+	}
+	return krpc.DecodeMessage(b, msg)
+}
+
+// HandleFunc registers fn to handle calls to service.procedure. fn is a
+// function whose parameters are the procedure's parameters, in order, and
+// which returns the procedure's return value, if any, optionally followed by
+// an error:
+//
+//	srv.HandleFunc("SpaceCenter", "Vessel_get_Name", func(vessel uint64) (string, error) {
+//		return "Kerbal X", nil
+//	})
+//
+// Parameters and return values may be numbers, bools, strings, byte slices,
+// enumerations, or krpc.Point, Vector, Quaternion or BoundingBox. Remote
+// objects are passed as their uint64 IDs. HandleFunc panics if fn has any
+// other type.
+func (s *Server) HandleFunc(service, procedure string, fn interface{}) {
+	s.Handle(service, procedure, funcHandler(fn))
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// funcHandler converts a function to a Handler, as described by HandleFunc.
+func funcHandler(fn interface{}) Handler {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		panic(fmt.Sprintf("krpctest: handler is %s, not a function", t))
+	}
+
+	decoders := make([]func([]byte) (reflect.Value, error), t.NumIn())
+	for i := range decoders {
+		decoders[i] = decoder(t.In(i))
+	}
+
+	returnsError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	results := t.NumOut()
+	if returnsError {
+		results--
+	}
+	var encode func(reflect.Value) []byte
+	switch results {
+	case 0:
+	case 1:
+		encode = encoder(t.Out(0))
+	default:
+		panic(fmt.Sprintf("krpctest: handler %s returns more than one value", t))
+	}
+
+	return func(call *pb.ProcedureCall) ([]byte, error) {
+		args := Args(call.GetArguments())
+		in := make([]reflect.Value, len(decoders))
+		for i, decode := range decoders {
+			b, err := args.Value(uint32(i))
+			if err != nil {
+				return nil, err
+			}
+			in[i], err = decode(b)
+			if err != nil {
+				return nil, errors.Wrapf(err, "argument %d", i)
+			}
+		}
+
+		out := v.Call(in)
+		if returnsError {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return nil, err
+			}
+		}
+		if encode == nil {
+			return nil, nil
+		}
+		return encode(out[0]), nil
+	}
+}
+
+var (
+	pointType       = reflect.TypeOf(krpc.Point{})
+	vectorType      = reflect.TypeOf(krpc.Vector{})
+	quaternionType  = reflect.TypeOf(krpc.Quaternion{})
+	boundingBoxType = reflect.TypeOf(krpc.BoundingBox{})
+)
+
+// decoder returns a function that decodes a value of type t.
+func decoder(t reflect.Type) func([]byte) (reflect.Value, error) {
+	decode := func(fn interface{}) func([]byte) (reflect.Value, error) {
+		f := reflect.ValueOf(fn)
+		return func(b []byte) (reflect.Value, error) {
+			out := f.Call([]reflect.Value{reflect.ValueOf(b)})
+			if err, _ := out[1].Interface().(error); err != nil {
+				return reflect.Value{}, err
+			}
+			return out[0].Convert(t), nil
+		}
+	}
+
+	switch t {
+	case pointType:
+		return decode(krpc.DecodePoint)
+	case vectorType:
+		return decode(krpc.DecodeVector)
+	case quaternionType:
+		return decode(krpc.DecodeQuaternion)
+	case boundingBoxType:
+		return decode(krpc.DecodeBoundingBox)
+	}
+	switch t.Kind() {
+	case reflect.Float64:
+		return decode(krpc.DecodeFloat64)
+	case reflect.Float32:
+		return decode(krpc.DecodeFloat32)
+	case reflect.Int32:
+		return decode(krpc.DecodeInt32)
+	case reflect.Int64:
+		return decode(krpc.DecodeInt64)
+	case reflect.Uint32:
+		return decode(krpc.DecodeUint32)
+	case reflect.Uint64:
+		return decode(krpc.DecodeUint64)
+	case reflect.Bool:
+		return decode(krpc.DecodeBool)
+	case reflect.String:
+		return decode(krpc.DecodeString)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return decode(krpc.DecodeBytes)
+		}
+	}
+	panic(fmt.Sprintf("krpctest: unsupported parameter type %s", t))
+}
+
+// encoder returns a function that encodes a value of type t.
+func encoder(t reflect.Type) func(reflect.Value) []byte {
+	encode := func(fn interface{}) func(reflect.Value) []byte {
+		f := reflect.ValueOf(fn)
+		in := f.Type().In(0)
+		return func(v reflect.Value) []byte {
+			return f.Call([]reflect.Value{v.Convert(in)})[0].Bytes()
+		}
+	}
+
+	switch t {
+	case pointType:
+		return encode(krpc.EncodePoint)
+	case vectorType:
+		return encode(krpc.EncodeVector)
+	case quaternionType:
+		return encode(krpc.EncodeQuaternion)
+	case boundingBoxType:
+		return encode(krpc.EncodeBoundingBox)
+	}
+	switch t.Kind() {
+	case reflect.Float64:
+		return encode(krpc.EncodeFloat64)
+	case reflect.Float32:
+		return encode(krpc.EncodeFloat32)
+	case reflect.Int32:
+		return encode(krpc.EncodeInt32)
+	case reflect.Int64:
+		return encode(krpc.EncodeInt64)
+	case reflect.Uint32:
+		return encode(krpc.EncodeUint32)
+	case reflect.Uint64:
+		return encode(krpc.EncodeUint64)
+	case reflect.Bool:
+		return encode(krpc.EncodeBool)
+	case reflect.String:
+		return encode(krpc.EncodeString)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return encode(krpc.EncodeBytes)
+		}
+	}
+	panic(fmt.Sprintf("krpctest: unsupported return type %s", t))
+}
+
+var exceptionType = reflect.TypeOf(krpc.Exception{})
+
+// exception returns the exception of err, if it is a *krpc.Exception or a
+// pointer to a struct that embeds krpc.Exception.
+func exception(err error) (krpc.Exception, bool) {
+	if e, ok := err.(*krpc.Exception); ok {
+		return *e, true
+	}
+	v := reflect.ValueOf(err)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return krpc.Exception{}, false
+	}
+	f := v.Elem().FieldByName("Exception")
+	if !f.IsValid() || f.Type() != exceptionType {
+		return krpc.Exception{}, false
+	}
+	return f.Interface().(krpc.Exception), true
+}
@@ -0,0 +1,697 @@
+// Package krpctest provides a fake kRPC server for testing clients without a
+// running game.
+//
+// The server speaks the TCP and WebSocket protocols of the RPC and stream
+// servers, and calls the handler registered for each procedure:
+//
+//	srv := krpctest.NewServer()
+//	defer srv.Close()
+//	srv.HandleFunc("SpaceCenter", "get_UT", func() float64 { return 1000 })
+//
+//	c, err := krpc.Dial(srv.Addr, krpc.WithStreamAddr(srv.StreamAddr))
+//
+// The KRPC service procedures for status, services, client identifiers,
+// streams and events are handled by the server itself. Streams are updated
+// when Update is called. Events can only be added for expressions made with
+// Expression.Call, and fire when the call's handler returns true.
+package krpctest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/ilikebits/jeb/krpc"
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// Version is the server version reported by KRPC.GetStatus.
+const Version = "0.4.8"
+
+// Server is a fake kRPC server listening on loopback ports.
+type Server struct {
+	// Addr and StreamAddr are the addresses of the RPC and stream servers, in
+	// the form "127.0.0.1:port".
+	Addr       string
+	StreamAddr string
+	// WebSocketURL and StreamWebSocketURL are the URLs of the RPC and stream
+	// servers' WebSocket listeners, in the form "ws://127.0.0.1:port/".
+	WebSocketURL       string
+	StreamWebSocketURL string
+
+	listeners []net.Listener
+	wg        sync.WaitGroup
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	services []*pb.Service
+	clients  map[string]*client
+	// conns are the open connections, and whether they are stream
+	// connections.
+	conns map[net.Conn]bool
+	// exprs are the procedure calls of expressions, by object ID.
+	exprs  map[uint64]*pb.ProcedureCall
+	nextID uint64
+}
+
+// client is the state of a connected client.
+type client struct {
+	id   []byte
+	name string
+
+	// mu guards stream and streams, and serializes writes to stream.
+	mu      sync.Mutex
+	stream  messenger
+	streams map[uint64]*stream
+}
+
+// stream is a procedure call added as a stream by a client.
+type stream struct {
+	call    *pb.ProcedureCall
+	started bool
+}
+
+// NewServer starts a server on loopback ports. It panics if it cannot listen,
+// since it is meant to be used in tests.
+func NewServer() *Server {
+	s := Server{
+		handlers: make(map[string]Handler),
+		clients:  make(map[string]*client),
+		conns:    make(map[net.Conn]bool),
+		exprs:    make(map[uint64]*pb.ProcedureCall),
+		nextID:   1,
+	}
+	s.handleKRPC()
+
+	s.Addr = s.listen(s.serveRPC, false)
+	s.StreamAddr = s.listen(s.serveStream, true)
+	s.WebSocketURL = "ws://" + s.listen(s.serveWebSocketRPC, false) + "/"
+	s.StreamWebSocketURL = "ws://" + s.listen(s.serveWebSocketStream, true) + "/"
+	return &s
+}
+
+// listen serves connections to a new loopback port with handle, returning
+// its address. stream is whether they are stream connections.
+func (s *Server) listen(handle func(net.Conn), stream bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.Close()
+		panic(fmt.Sprintf("krpctest: listen: %v", err))
+	}
+	s.listeners = append(s.listeners, l)
+
+	s.wg.Add(1)
+	go s.serve(l, handle, stream)
+	return l.Addr().String()
+}
+
+// Close stops the server and closes every client connection.
+func (s *Server) Close() error {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.Disconnect()
+
+	s.wg.Wait()
+	return nil
+}
+
+// Disconnect closes every client connection, as a server restarting would,
+// but keeps listening for new connections.
+func (s *Server) Disconnect() {
+	s.closeConns(false)
+}
+
+// DisconnectStreams closes every stream connection, leaving the RPC
+// connections open.
+func (s *Server) DisconnectStreams() {
+	s.closeConns(true)
+}
+
+// closeConns closes the stream connections, or every connection if
+// streamsOnly is false.
+func (s *Server) closeConns(streamsOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, stream := range s.conns {
+		if stream || !streamsOnly {
+			conn.Close()
+		}
+	}
+}
+
+// Handle registers h to handle calls to service.procedure, replacing any
+// existing handler.
+func (s *Server) Handle(service, procedure string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[service+"."+procedure] = h
+}
+
+// AddService adds a service to those returned by KRPC.GetServices, replacing
+// any service of the same name. Omitted arguments of its procedures are given
+// their default values before calling their handlers, which must be
+// registered with Handle or HandleFunc.
+func (s *Server) AddService(service *pb.Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, existing := range s.services {
+		if existing.GetName() == service.GetName() {
+			s.services[i] = service
+			return
+		}
+	}
+	s.services = append(s.services, service)
+}
+
+// Update sends every client the current values of its started streams, by
+// calling the handlers of their procedures.
+func (s *Server) Update() {
+	s.mu.Lock()
+	var clients []*client
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		c.mu.Lock()
+		update := pb.StreamUpdate{}
+		for id, st := range c.streams {
+			if !st.started {
+				continue
+			}
+			update.Results = append(update.Results, &pb.StreamResult{
+				Id:     id,
+				Result: s.call(st.call),
+			})
+		}
+		if c.stream != nil && len(update.Results) > 0 {
+			c.stream.write(&update)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// serve accepts connections from l until it is closed.
+func (s *Server) serve(l net.Listener, handle func(net.Conn), stream bool) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = stream
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// serveRPC performs the handshake of an RPC connection and answers its
+// requests.
+func (s *Server) serveRPC(conn net.Conn) {
+	m := newTCPMessenger(conn)
+	req := pb.ConnectionRequest{}
+	if err := m.read(&req); err != nil {
+		return
+	}
+	if req.GetType() != pb.ConnectionRequest_RPC {
+		m.write(&pb.ConnectionResponse{
+			Status:  pb.ConnectionResponse_WRONG_TYPE,
+			Message: "Connection request was for the stream server, but this is the rpc server.",
+		})
+		return
+	}
+
+	c := s.connect(req.GetClientName())
+	defer s.disconnect(c)
+	m.write(&pb.ConnectionResponse{
+		Status:           pb.ConnectionResponse_OK,
+		ClientIdentifier: c.id,
+	})
+	s.serveRequests(c, m)
+}
+
+// serveWebSocketRPC upgrades a WebSocket RPC connection, which passes the
+// client name in the URL instead of a handshake message, and answers its
+// requests.
+func (s *Server) serveWebSocketRPC(conn net.Conn) {
+	req, w, err := readUpgrade(conn)
+	if err != nil {
+		return
+	}
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+
+	c := s.connect(req.URL.Query().Get("name"))
+	defer s.disconnect(c)
+	s.serveRequests(c, &websocketMessenger{ws: ws})
+}
+
+// connect adds a client named name.
+func (s *Server) connect(name string) *client {
+	c := &client{
+		id:      newClientID(),
+		name:    name,
+		streams: make(map[uint64]*stream),
+	}
+	s.mu.Lock()
+	s.clients[string(c.id)] = c
+	s.mu.Unlock()
+	return c
+}
+
+// disconnect removes client c, once its RPC connection is closed.
+func (s *Server) disconnect(c *client) {
+	s.mu.Lock()
+	delete(s.clients, string(c.id))
+	s.mu.Unlock()
+}
+
+// serveRequests answers the requests of client c until its connection is
+// closed.
+func (s *Server) serveRequests(c *client, m messenger) {
+	for {
+		req := pb.Request{}
+		if err := m.read(&req); err != nil {
+			return
+		}
+
+		res := pb.Response{}
+		for _, call := range req.GetCalls() {
+			res.Results = append(res.Results, s.callFrom(c, call))
+		}
+		if err := m.write(&res); err != nil {
+			return
+		}
+	}
+}
+
+// serveStream performs the handshake of a stream connection, which then only
+// receives updates.
+func (s *Server) serveStream(conn net.Conn) {
+	m := newTCPMessenger(conn)
+	req := pb.ConnectionRequest{}
+	if err := m.read(&req); err != nil {
+		return
+	}
+	if req.GetType() != pb.ConnectionRequest_STREAM {
+		m.write(&pb.ConnectionResponse{
+			Status:  pb.ConnectionResponse_WRONG_TYPE,
+			Message: "Connection request was for the rpc server, but this is the stream server.",
+		})
+		return
+	}
+
+	c, ok := s.client(req.GetClientIdentifier())
+	if !ok {
+		m.write(&pb.ConnectionResponse{
+			Status:  pb.ConnectionResponse_MALFORMED_MESSAGE,
+			Message: "Client identifier does not match an RPC connection.",
+		})
+		return
+	}
+	s.serveUpdates(c, m, &pb.ConnectionResponse{
+		Status:           pb.ConnectionResponse_OK,
+		ClientIdentifier: c.id,
+	})
+}
+
+// serveWebSocketStream upgrades a WebSocket stream connection, which passes
+// the base64-encoded client identifier in the URL instead of a handshake
+// message, and which then only receives updates.
+func (s *Server) serveWebSocketStream(conn net.Conn) {
+	req, w, err := readUpgrade(conn)
+	if err != nil {
+		return
+	}
+	id, err := base64.StdEncoding.DecodeString(req.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Malformed client identifier.", http.StatusBadRequest)
+		return
+	}
+	c, ok := s.client(id)
+	if !ok {
+		http.Error(w, "Client identifier does not match an RPC connection.", http.StatusBadRequest)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	s.serveUpdates(c, &websocketMessenger{ws: ws}, nil)
+}
+
+// client returns the client with identifier id.
+func (s *Server) client(id []byte) (*client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.clients[string(id)]
+	return c, ok
+}
+
+// serveUpdates makes m the stream connection of client c, sending res if it
+// is not nil, and waits for the client to disconnect.
+func (s *Server) serveUpdates(c *client, m messenger, res *pb.ConnectionResponse) {
+	c.mu.Lock()
+	c.stream = m
+	if res != nil {
+		m.write(res)
+	}
+	c.mu.Unlock()
+
+	m.drain()
+
+	c.mu.Lock()
+	if c.stream == m {
+		c.stream = nil
+	}
+	c.mu.Unlock()
+}
+
+// callFrom makes a call on behalf of client c.
+func (s *Server) callFrom(c *client, call *pb.ProcedureCall) *pb.ProcedureResult {
+	switch call.GetService() + "." + call.GetProcedure() {
+	case "KRPC.GetClientID":
+		return &pb.ProcedureResult{Value: krpc.EncodeBytes(c.id)}
+	case "KRPC.GetClientName":
+		return &pb.ProcedureResult{Value: krpc.EncodeString(c.name)}
+	case "KRPC.AddStream":
+		return s.addStream(c, call)
+	case "KRPC.Expression_static_Call":
+		return s.addExpression(call)
+	case "KRPC.AddEvent":
+		return s.addEvent(c, call)
+	case "KRPC.StartStream", "KRPC.SetStreamRate", "KRPC.RemoveStream":
+		return s.updateStream(c, call)
+	}
+	return s.call(call)
+}
+
+// call calls the handler for call.
+func (s *Server) call(call *pb.ProcedureCall) *pb.ProcedureResult {
+	s.mu.Lock()
+	h, ok := s.handlers[call.GetService()+"."+call.GetProcedure()]
+	s.mu.Unlock()
+
+	if !ok {
+		return &pb.ProcedureResult{Error: &pb.Error{
+			Service:     "KRPC",
+			Name:        "InvalidOperationException",
+			Description: fmt.Sprintf("Procedure not found: %s.%s", call.GetService(), call.GetProcedure()),
+		}}
+	}
+
+	value, err := h(s.withDefaults(call))
+	if err != nil {
+		return &pb.ProcedureResult{Error: toError(err)}
+	}
+	return &pb.ProcedureResult{Value: value}
+}
+
+// withDefaults returns call with the default values of omitted arguments
+// added, if its procedure is described by a service added with AddService.
+func (s *Server) withDefaults(call *pb.ProcedureCall) *pb.ProcedureCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, service := range s.services {
+		if service.GetName() != call.GetService() {
+			continue
+		}
+		for _, proc := range service.GetProcedures() {
+			if proc.GetName() != call.GetProcedure() {
+				continue
+			}
+			args := Args(call.GetArguments())
+			withDefaults := *call
+			withDefaults.Arguments = append([]*pb.Argument(nil), args...)
+			for i, param := range proc.GetParameters() {
+				if _, err := args.Value(uint32(i)); err != nil && param.GetDefaultValue() != nil {
+					withDefaults.Arguments = append(withDefaults.Arguments, &pb.Argument{
+						Position: uint32(i),
+						Value:    param.GetDefaultValue(),
+					})
+				}
+			}
+			return &withDefaults
+		}
+	}
+	return call
+}
+
+func (s *Server) addStream(c *client, call *pb.ProcedureCall) *pb.ProcedureResult {
+	args := Args(call.GetArguments())
+	streamCall := pb.ProcedureCall{}
+	err := args.Message(0, &streamCall)
+	if err != nil {
+		return &pb.ProcedureResult{Error: toError(err)}
+	}
+	start := true
+	if len(args) > 1 {
+		start, err = args.Bool(1)
+		if err != nil {
+			return &pb.ProcedureResult{Error: toError(err)}
+		}
+	}
+
+	value, err := krpc.EncodeMessage(&pb.Stream{Id: s.newStream(c, &streamCall, start)})
+	if err != nil {
+		return &pb.ProcedureResult{Error: toError(err)}
+	}
+	return &pb.ProcedureResult{Value: value}
+}
+
+// newStream adds a stream of call for client c, returning its ID.
+func (s *Server) newStream(c *client, call *pb.ProcedureCall, start bool) uint64 {
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.streams[id] = &stream{call: call, started: start}
+	c.mu.Unlock()
+	return id
+}
+
+// addExpression adds an expression that evaluates to the result of a
+// procedure call.
+func (s *Server) addExpression(call *pb.ProcedureCall) *pb.ProcedureResult {
+	exprCall := pb.ProcedureCall{}
+	err := Args(call.GetArguments()).Message(0, &exprCall)
+	if err != nil {
+		return &pb.ProcedureResult{Error: toError(err)}
+	}
+
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	s.exprs[id] = &exprCall
+	s.mu.Unlock()
+	return &pb.ProcedureResult{Value: krpc.EncodeObject(id)}
+}
+
+// addEvent adds an event for an expression, as a stream of its call that is
+// not started.
+func (s *Server) addEvent(c *client, call *pb.ProcedureCall) *pb.ProcedureResult {
+	exprID, err := Args(call.GetArguments()).Object(0)
+	if err != nil {
+		return &pb.ProcedureResult{Error: toError(err)}
+	}
+	s.mu.Lock()
+	exprCall, ok := s.exprs[exprID]
+	s.mu.Unlock()
+	if !ok {
+		return &pb.ProcedureResult{Error: toError(&krpc.Exception{
+			Service:     "KRPC",
+			Name:        "ArgumentException",
+			Description: fmt.Sprintf("Expression does not exist: %d", exprID),
+		})}
+	}
+
+	value, err := krpc.EncodeMessage(&pb.Event{Stream: &pb.Stream{Id: s.newStream(c, exprCall, false)}})
+	if err != nil {
+		return &pb.ProcedureResult{Error: toError(err)}
+	}
+	return &pb.ProcedureResult{Value: value}
+}
+
+func (s *Server) updateStream(c *client, call *pb.ProcedureCall) *pb.ProcedureResult {
+	id, err := Args(call.GetArguments()).Uint64(0)
+	if err != nil {
+		return &pb.ProcedureResult{Error: toError(err)}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, ok := c.streams[id]
+	if !ok {
+		return &pb.ProcedureResult{Error: toError(&krpc.Exception{
+			Service:     "KRPC",
+			Name:        "ArgumentException",
+			Description: fmt.Sprintf("Stream does not exist: %d", id),
+		})}
+	}
+	switch call.GetProcedure() {
+	case "StartStream":
+		st.started = true
+	case "RemoveStream":
+		delete(c.streams, id)
+	}
+	return &pb.ProcedureResult{}
+}
+
+// handleKRPC registers the KRPC service procedures that do not depend on the
+// client.
+func (s *Server) handleKRPC() {
+	s.Handle("KRPC", "GetStatus", func(*pb.ProcedureCall) ([]byte, error) {
+		return krpc.EncodeMessage(&pb.Status{Version: Version})
+	})
+	s.Handle("KRPC", "GetServices", func(*pb.ProcedureCall) ([]byte, error) {
+		s.mu.Lock()
+		services := append([]*pb.Service{krpcService}, s.services...)
+		s.mu.Unlock()
+		return krpc.EncodeMessage(&pb.Services{Services: services})
+	})
+}
+
+// krpcService describes the KRPC service procedures handled by the server.
+var krpcService = &pb.Service{
+	Name: "KRPC",
+	Procedures: []*pb.Procedure{
+		{Name: "GetStatus", ReturnType: &pb.Type{Code: pb.Type_STATUS}},
+		{Name: "GetServices", ReturnType: &pb.Type{Code: pb.Type_SERVICES}},
+		{Name: "GetClientID", ReturnType: &pb.Type{Code: pb.Type_BYTES}},
+		{Name: "GetClientName", ReturnType: &pb.Type{Code: pb.Type_STRING}},
+		{
+			Name: "AddStream",
+			Parameters: []*pb.Parameter{
+				{Name: "call", Type: &pb.Type{Code: pb.Type_PROCEDURE_CALL}},
+				{Name: "start", Type: &pb.Type{Code: pb.Type_BOOL}, DefaultValue: krpc.EncodeBool(true)},
+			},
+			ReturnType: &pb.Type{Code: pb.Type_STREAM},
+		},
+		{Name: "StartStream", Parameters: []*pb.Parameter{{Name: "id", Type: &pb.Type{Code: pb.Type_UINT64}}}},
+		{
+			Name: "SetStreamRate",
+			Parameters: []*pb.Parameter{
+				{Name: "id", Type: &pb.Type{Code: pb.Type_UINT64}},
+				{Name: "rate", Type: &pb.Type{Code: pb.Type_FLOAT}},
+			},
+		},
+		{Name: "RemoveStream", Parameters: []*pb.Parameter{{Name: "id", Type: &pb.Type{Code: pb.Type_UINT64}}}},
+		{
+			Name:       "AddEvent",
+			Parameters: []*pb.Parameter{{Name: "expression", Type: expressionType}},
+			ReturnType: &pb.Type{Code: pb.Type_EVENT},
+		},
+		{
+			Name:       "Expression_static_Call",
+			Parameters: []*pb.Parameter{{Name: "call", Type: &pb.Type{Code: pb.Type_PROCEDURE_CALL}}},
+			ReturnType: expressionType,
+		},
+	},
+	Classes: []*pb.Class{{Name: "Expression"}},
+}
+
+var expressionType = &pb.Type{Code: pb.Type_CLASS, Service: "KRPC", Name: "Expression"}
+
+// toError converts an error returned by a handler into an error for the
+// client. Exceptions keep their service and name.
+func toError(err error) *pb.Error {
+	if e, ok := exception(err); ok {
+		return &pb.Error{
+			Service:     e.Service,
+			Name:        e.Name,
+			Description: e.Description,
+			StackTrace:  e.StackTrace,
+		}
+	}
+	return &pb.Error{Description: err.Error()}
+}
+
+// newClientID returns a random client identifier.
+func newClientID() []byte {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("krpctest: client identifier: %v", err))
+	}
+	return id
+}
+
+// messenger reads and writes the messages of a connection.
+type messenger interface {
+	read(msg proto.Message) error
+	write(msg proto.Message) error
+	// drain discards what the client sends until it disconnects.
+	drain()
+}
+
+// tcpMessenger sends varint-delimited messages over TCP.
+type tcpMessenger struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func newTCPMessenger(conn net.Conn) *tcpMessenger {
+	return &tcpMessenger{r: bufio.NewReader(conn), w: conn}
+}
+
+func (m *tcpMessenger) read(msg proto.Message) error {
+	size, err := binary.ReadUvarint(m.r)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(m.r, buf)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(proto.Unmarshal(buf, msg), "decode message")
+}
+
+func (m *tcpMessenger) write(msg proto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = m.w.Write(append(proto.EncodeVarint(uint64(len(data))), data...))
+	return err
+}
+
+func (m *tcpMessenger) drain() {
+	io.Copy(ioutil.Discard, m.r)
+}
@@ -0,0 +1,288 @@
+package krpctest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/ilikebits/jeb/krpc"
+	"github.com/ilikebits/jeb/krpc/krpctest"
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// value is a float64 that handlers read while tests change it.
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.v
+}
+
+func (v *value) set(f float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.v = f
+}
+
+// call calls Test.procedure with args.
+func call(c *krpc.Client, procedure string, args ...[]byte) ([]byte, error) {
+	b := c.Batch()
+	call := pb.ProcedureCall{Service: "Test", Procedure: procedure}
+	for i, arg := range args {
+		call.Arguments = append(call.Arguments, &pb.Argument{Position: uint32(i), Value: arg})
+	}
+	b.Add(&call)
+	results, err := b.Execute()
+	if err != nil {
+		return nil, err
+	}
+	return results[0].Value, results[0].Err
+}
+
+// waitUpdate updates srv until updates receives want.
+func waitUpdate(t *testing.T, srv *krpctest.Server, updates <-chan float64, want float64) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		srv.Update()
+		select {
+		case v, ok := <-updates:
+			if !ok {
+				t.Fatal("updates closed")
+			}
+			if v == want {
+				return
+			}
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("no update to %v", want)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	srv.HandleFunc("Test", "Add", func(a, b int32) int32 { return a + b })
+	srv.HandleFunc("Test", "Fail", func() error {
+		return &krpc.Exception{Service: "Test", Name: "FailedException", Description: "failed"}
+	})
+	srv.HandleFunc("Test", "Error", func() error { return errors.New("broken") })
+	c, err := krpc.Dial(srv.Addr, krpc.WithStreamAddr(srv.StreamAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	status, err := c.KRPC.GetStatus()
+	if err != nil || status.GetVersion() != krpctest.Version {
+		t.Errorf("GetStatus: got %v, %v, want version %s", status.GetVersion(), err, krpctest.Version)
+	}
+
+	b, err := call(c, "Add", krpc.EncodeInt32(2), krpc.EncodeInt32(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := krpc.DecodeInt32(b); err != nil || sum != 5 {
+		t.Errorf("Add(2, 3): got %v, %v, want 5", sum, err)
+	}
+	if _, err := call(c, "Add", krpc.EncodeInt32(2)); err == nil {
+		t.Error("Add with a missing argument succeeded")
+	}
+
+	// Exceptions keep their service and name, and other errors are reported
+	// as KRPC exceptions.
+	_, err = call(c, "Fail")
+	if e, ok := err.(*krpc.Exception); !ok || e.Service != "Test" || e.Name != "FailedException" || e.Description != "failed" {
+		t.Errorf("Fail: got error %#v", err)
+	}
+	if _, err := call(c, "Error"); err == nil {
+		t.Error("Error succeeded")
+	}
+	if _, err := call(c, "Missing"); err == nil {
+		t.Error("call of a missing procedure succeeded")
+	}
+}
+
+func TestStreams(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	var ut value
+	srv.HandleFunc("Test", "get_UT", ut.get)
+	c, err := krpc.Dial(srv.Addr, krpc.WithStreamAddr(srv.StreamAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "Test", Procedure: "get_UT"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := s.AsFloat64()
+
+	// Streams are only updated once started.
+	ut.set(1)
+	srv.Update()
+	select {
+	case v := <-stream.Updates():
+		t.Fatalf("got update %v before the stream was started", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := stream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitUpdate(t, srv, stream.Updates(), 1)
+	ut.set(2)
+	waitUpdate(t, srv, stream.Updates(), 2)
+
+	if err := stream.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.KRPC.StartStream(s.ID()); err == nil {
+		t.Error("started a removed stream")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	var altitude value
+	srv.HandleFunc("Test", "get_Above", func() bool { return altitude.get() > 1000 })
+	c, err := krpc.Dial(srv.Addr, krpc.WithStreamAddr(srv.StreamAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expr, err := c.KRPC.Expression().Call(&pb.ProcedureCall{Service: "Test", Procedure: "get_Above"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := c.KRPC.AddEvent(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fired := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		fired <- event.Wait(ctx)
+	}()
+	for {
+		srv.Update()
+		select {
+		case err := <-fired:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if altitude.get() <= 1000 {
+				t.Fatal("event fired before its expression was true")
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			altitude.set(2000)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	srv.HandleFunc("Test", "Echo", func(s string) string { return s })
+	var ut value
+	srv.HandleFunc("Test", "get_UT", ut.get)
+	c, err := krpc.DialWebSocket(srv.WebSocketURL, krpc.WithStreamAddr(srv.StreamWebSocketURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	b, err := call(c, "Echo", krpc.EncodeString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := krpc.DecodeString(b); err != nil || s != "hello" {
+		t.Errorf("Echo: got %q, %v, want hello", s, err)
+	}
+
+	s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "Test", Procedure: "get_UT"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut.set(1)
+	waitUpdate(t, srv, s.AsFloat64().Updates(), 1)
+}
+
+func TestWebSocketUnknownClient(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+
+	_, res, err := websocket.DefaultDialer.Dial(srv.StreamWebSocketURL+"?id=AAAA", nil)
+	if err != websocket.ErrBadHandshake {
+		t.Fatalf("got %v, want %v", err, websocket.ErrBadHandshake)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %s, want %d", res.Status, http.StatusBadRequest)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	srv.HandleFunc("Test", "Echo", func(s string) string { return s })
+	c, err := krpc.Dial(srv.Addr, krpc.WithStreamAddr(srv.StreamAddr),
+		krpc.WithReconnect(krpc.ExponentialBackoff(10*time.Millisecond, 100*time.Millisecond, 20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The client reconnects to the server, which keeps listening.
+	srv.Disconnect()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := call(c, "Echo", krpc.EncodeString("hello")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDisconnectStreams(t *testing.T) {
+	srv := krpctest.NewServer()
+	defer srv.Close()
+	srv.HandleFunc("Test", "Echo", func(s string) string { return s })
+	c, err := krpc.Dial(srv.Addr, krpc.WithStreamAddr(srv.StreamAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	srv.DisconnectStreams()
+	select {
+	case <-c.Stream.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream client did not stop")
+	}
+
+	// The RPC connection stays open.
+	if _, err := call(c, "Echo", krpc.EncodeString("hello")); err != nil {
+		t.Error(err)
+	}
+}
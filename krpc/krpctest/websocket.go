@@ -0,0 +1,87 @@
+package krpctest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// upgrader upgrades the connections of the WebSocket servers.
+var upgrader websocket.Upgrader
+
+// readUpgrade reads a WebSocket upgrade request from conn, returning it with
+// the response writer to upgrade or reject it with.
+func readUpgrade(conn net.Conn) (*http.Request, *upgradeResponse, error) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return req, &upgradeResponse{
+		conn:   conn,
+		rw:     bufio.NewReadWriter(r, bufio.NewWriter(conn)),
+		header: make(http.Header),
+	}, nil
+}
+
+// upgradeResponse is the response to an upgrade request read from conn,
+// which the upgrader hijacks to complete the upgrade. Any other response
+// closes the connection once written.
+type upgradeResponse struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	header http.Header
+}
+
+func (w *upgradeResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *upgradeResponse) WriteHeader(status int) {
+	w.header.Set("Connection", "close")
+	fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	w.header.Write(w.conn)
+	fmt.Fprintf(w.conn, "\r\n")
+}
+
+func (w *upgradeResponse) Write(p []byte) (int, error) {
+	return w.conn.Write(p)
+}
+
+func (w *upgradeResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, w.rw, nil
+}
+
+// websocketMessenger sends each message as a binary WebSocket message.
+type websocketMessenger struct {
+	ws *websocket.Conn
+}
+
+func (m *websocketMessenger) read(msg proto.Message) error {
+	_, data, err := m.ws.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(proto.Unmarshal(data, msg), "decode message")
+}
+
+func (m *websocketMessenger) write(msg proto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return m.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (m *websocketMessenger) drain() {
+	for {
+		if _, _, err := m.ws.NextReader(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package krpc
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// Field is a key-value pair attached to a log message, such as the service
+// and procedure of a call.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives log messages from connections. Implementations must be safe
+// for concurrent use. Use WithLogger to set the logger of a connection; by
+// default, nothing is logged.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...Field) {}
+
+// NopLogger is a Logger that discards every message.
+var NopLogger Logger = nopLogger{}
+
+// stdLogger adapts a standard library logger.
+type stdLogger struct {
+	l   *log.Logger
+	min Level
+}
+
+// StdLogger returns a Logger that writes messages of at least level min to l,
+// with fields formatted as key=value pairs. If l is nil, the standard logger
+// is used.
+func StdLogger(l *log.Logger, min Level) Logger {
+	return stdLogger{l: l, min: min}
+}
+
+func (s stdLogger) Log(level Level, msg string, fields ...Field) {
+	if level < s.min {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+
+	if s.l == nil {
+		log.Output(2, b.String())
+		return
+	}
+	s.l.Output(2, b.String())
+}
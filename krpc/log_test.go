@@ -0,0 +1,67 @@
+package krpc
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+	"testing"
+)
+
+// testLogger records the messages logged to it.
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Log(level Level, msg string, fields ...Field) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.msgs = append(l.msgs, level.String()+" "+msg)
+}
+
+func (l *testLogger) logged(msg string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, m := range l.msgs {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWithLogger(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	l := testLogger{}
+	c := dial(t, srv, WithLogger(&l))
+	defer c.Close()
+
+	if _, err := echo(context.Background(), c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"INFO connected", "DEBUG call"} {
+		if !l.logged(msg) {
+			t.Errorf("%q not logged in %q", msg, l.msgs)
+		}
+	}
+	if l.logged("DEBUG send") {
+		t.Error("messages logged without a wire trace")
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := StdLogger(log.New(&buf, "", 0), LevelInfo)
+	l.Log(LevelDebug, "hidden")
+	l.Log(LevelWarn, "reconnecting", Field{"attempt", 2}, Field{"addr", "127.0.0.1:50000"})
+
+	want := "WARN reconnecting attempt=2 addr=127.0.0.1:50000\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
@@ -1,70 +1,183 @@
 package krpc
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/protobuf/proto"
+
+	"github.com/ilikebits/jeb/krpc/pb"
 )
 
 func (c *Conn) Send(msg proto.Message) (int, error) {
-	log.Printf("Send: %#v", msg)
-
 	data, err := proto.Marshal(msg)
 	if err != nil {
 		return 0, err
 	}
-	m, err := c.conn.Write(proto.EncodeVarint(uint64(len(data))))
-	if err != nil {
-		return m, err
+	if c.trace {
+		c.log.Log(LevelDebug, "send", Field{"size", len(data)}, Field{"message", proto.CompactTextString(msg)})
+	}
+	if c.rec != nil {
+		c.rec.record(c.kind, "send", msg, data)
 	}
-	n, err := c.conn.Write(data)
+	err = c.frames.WriteMessage(data)
 	if err != nil {
-		return m + n, err
+		return 0, err
 	}
-	return m + n, nil
+	return len(data), nil
 }
 
-func (c *Conn) Read(msg proto.Message) error {
-	log.Printf("Read: %#v", msg)
+// DefaultMaxMessageSize is the default limit on the size of messages read
+// from the server.
+const DefaultMaxMessageSize = 64 << 20
 
-	// Read varint-encoded message size.
-	msglen, err := binary.ReadUvarint(c)
-	if err != nil {
-		return err
+// ErrMessageTooLarge is the cause of a FrameError for a message larger than
+// the connection's maximum message size.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// FrameError is returned when a message frame cannot be read, because it is
+// too large or because the connection ended partway through it.
+type FrameError struct {
+	// Size is the size of the message in bytes, as given by its frame, or
+	// 0 if it is not known.
+	Size uint64
+	// Err is ErrMessageTooLarge or io.ErrUnexpectedEOF.
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	if e.Size == 0 {
+		return fmt.Sprintf("read message: %v", e.Err)
 	}
-	log.Printf("msglen: %#v", msglen)
+	return fmt.Sprintf("read message of %d bytes: %v", e.Size, e.Err)
+}
 
-	// Read message.
-	buf := make([]byte, msglen)
-	_, err = c.conn.Read(buf)
+// Cause returns the underlying error, for use with errors.Cause.
+func (e *FrameError) Cause() error {
+	return e.Err
+}
+
+// SetMaxMessageSize sets the largest message, in bytes, that Read will
+// accept. Larger messages are rejected with a FrameError rather than
+// allocated.
+func (c *Conn) SetMaxMessageSize(n uint64) {
+	atomic.StoreUint64(&c.maxSize, n)
+}
+
+func (c *Conn) Read(msg proto.Message) error {
+	buf, err := c.frames.ReadMessage(atomic.LoadUint64(&c.maxSize))
 	if err != nil {
 		return err
 	}
 
 	// Decode message contents.
-	log.Printf("proto.Unmarshal(%#v, %#v)", buf, msg)
 	err = proto.Unmarshal(buf, msg)
 	if err != nil {
 		return err
 	}
-	log.Println("done unmarshalling buffer")
+	if c.trace {
+		c.log.Log(LevelDebug, "read", Field{"size", len(buf)}, Field{"message", proto.CompactTextString(msg)})
+	}
+	if c.rec != nil {
+		c.rec.record(c.kind, "recv", msg, buf)
+	}
 
 	return nil
 }
 
-func (c *Conn) ReadByte() (byte, error) {
-	log.Println("ReadByte()")
+// framer reads and writes whole messages on a connection, delimiting them as
+// its transport requires.
+type framer interface {
+	WriteMessage(data []byte) error
+	// ReadMessage reads a message, returning a FrameError if it is larger
+	// than max bytes.
+	ReadMessage(max uint64) ([]byte, error)
+}
+
+// varintFramer delimits messages with their varint-encoded size, as the TCP
+// and serial servers do.
+type varintFramer struct {
+	w io.Writer
+	r *bufio.Reader
+}
 
-	b := make([]byte, 1)
-	n, err := c.conn.Read(b)
+func newVarintFramer(rw io.ReadWriter) *varintFramer {
+	return &varintFramer{w: rw, r: bufio.NewReader(rw)}
+}
+
+func (f *varintFramer) WriteMessage(data []byte) error {
+	_, err := f.w.Write(append(proto.EncodeVarint(uint64(len(data))), data...))
+	return err
+}
+
+func (f *varintFramer) ReadMessage(max uint64) ([]byte, error) {
+	// Read varint-encoded message size.
+	msglen, err := binary.ReadUvarint(f.r)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if msglen > max {
+		return nil, &FrameError{Size: msglen, Err: ErrMessageTooLarge}
+	}
+
+	// Read message.
+	buf := make([]byte, msglen)
+	_, err = io.ReadFull(f.r, buf)
+	if err != nil {
+		return nil, frameError(msglen, err)
+	}
+	return buf, nil
+}
+
+// frameError converts the end of the connection partway through a frame into
+// a FrameError.
+func frameError(size uint64, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &FrameError{Size: size, Err: io.ErrUnexpectedEOF}
+	}
+	return err
+}
+
+// Invoke makes a single procedure call and returns the encoded result value.
+// Generated service clients call procedures with it.
+func (c *Conn) Invoke(ctx context.Context, call *pb.ProcedureCall) ([]byte, error) {
+	start := time.Now()
+	value, err := c.invokeOnce(ctx, call)
+	fields := []Field{
+		{"service", call.GetService()},
+		{"procedure", call.GetProcedure()},
+		{"latency", time.Since(start)},
+	}
+	if err != nil {
+		c.log.Log(LevelDebug, "call failed", append(fields, Field{"error", err})...)
+		return nil, err
+	}
+	c.log.Log(LevelDebug, "call", fields...)
+	return value, nil
+}
+
+func (c *Conn) invokeOnce(ctx context.Context, call *pb.ProcedureCall) ([]byte, error) {
+	res, err := c.Call(ctx, &pb.Request{
+		Calls: []*pb.ProcedureCall{call},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if e := res.GetError(); e != nil {
+		return nil, newError(e)
+	}
+	if len(res.GetResults()) != 1 {
+		return nil, fmt.Errorf("call returned %d results", len(res.GetResults()))
 	}
-	if n != 1 {
-		return 0, errors.New("ReadByte: read wrong length")
+	result := res.GetResults()[0]
+	if e := result.GetError(); e != nil {
+		return nil, newError(e)
 	}
-	log.Printf("b: %#v", b)
-	return b[0], nil
+	return result.GetValue(), nil
 }
@@ -0,0 +1,66 @@
+package krpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// pipeConn returns a connection that reads what is written to w.
+func pipeConn() (c *Conn, w net.Conn) {
+	client, server := net.Pipe()
+	o := options{logger: NopLogger, maxSize: DefaultMaxMessageSize}
+	return newConn(client, newVarintFramer(client), "", o), server
+}
+
+func TestReadLargeMessage(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	c := dial(t, srv)
+	defer c.Close()
+
+	// The response arrives in many TCP reads.
+	want := strings.Repeat("Kerbal X ", 1<<17)
+	got, err := echo(context.Background(), c, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	c, w := pipeConn()
+	defer c.Close()
+	c.SetMaxMessageSize(10)
+	go writeTestMessage(w, &pb.Status{Version: "a version longer than ten bytes"})
+
+	err := c.Read(&pb.Status{})
+	if e, ok := err.(*FrameError); !ok || errors.Cause(e) != ErrMessageTooLarge {
+		t.Errorf("got error %v, want a message too large", err)
+	}
+}
+
+func TestReadTruncatedMessage(t *testing.T) {
+	c, w := pipeConn()
+	defer c.Close()
+	go func() {
+		data, _ := proto.Marshal(&pb.Status{Version: "0.4.8"})
+		w.Write(append(proto.EncodeVarint(uint64(len(data))), data[:len(data)-1]...))
+		w.Close()
+	}()
+
+	err := c.Read(&pb.Status{})
+	if e, ok := err.(*FrameError); !ok || errors.Cause(e) != io.ErrUnexpectedEOF {
+		t.Errorf("got error %v, want an unexpected EOF", err)
+	}
+}
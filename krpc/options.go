@@ -0,0 +1,204 @@
+package krpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultClientName is the name connections identify themselves with to the
+// server, unless WithClientName is used.
+const DefaultClientName = "jeb"
+
+// Option configures a connection made with Dial, Connect or DialStream.
+type Option func(*options)
+
+type options struct {
+	logger   Logger
+	trace    bool
+	recorder *Recorder
+	maxSize  uint64
+
+	clientName  string
+	dialTimeout time.Duration
+	keepAlive   time.Duration
+	dialer      *net.Dialer
+	proxy       func(*http.Request) (*url.URL, error)
+	conn        net.Conn
+	streamConn  net.Conn
+
+	stream     bool
+	streamAddr string
+
+	reconnect Backoff
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		logger:     NopLogger,
+		maxSize:    DefaultMaxMessageSize,
+		clientName: DefaultClientName,
+		proxy:      http.ProxyFromEnvironment,
+		stream:     true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger sets the logger that connections report calls and failures to.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithWireTrace enables logging every message sent and received at
+// LevelDebug. This is very verbose, so it is enabled separately from the
+// logger.
+func WithWireTrace(enabled bool) Option {
+	return func(o *options) {
+		o.trace = enabled
+	}
+}
+
+// WithRecorder records every message sent and received by connections to r,
+// so that the session can be replayed later.
+func WithRecorder(r *Recorder) Option {
+	return func(o *options) {
+		o.recorder = r
+	}
+}
+
+// WithMaxMessageSize sets the largest message, in bytes, that connections
+// will read. See Conn.SetMaxMessageSize.
+func WithMaxMessageSize(n uint64) Option {
+	return func(o *options) {
+		o.maxSize = n
+	}
+}
+
+// WithClientName sets the name that the client is shown as in the server's
+// list of clients.
+func WithClientName(name string) Option {
+	return func(o *options) {
+		o.clientName = name
+	}
+}
+
+// WithDialTimeout limits how long each connection may take to open and
+// complete its handshake.
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithKeepAlive sets the TCP keepalive period of connections. A negative
+// period disables keepalives.
+func WithKeepAlive(d time.Duration) Option {
+	return func(o *options) {
+		o.keepAlive = d
+	}
+}
+
+// WithDialer sets the dialer used to open connections. Dial timeouts and
+// keepalives set with other options override the dialer's.
+func WithDialer(d *net.Dialer) Option {
+	return func(o *options) {
+		o.dialer = d
+	}
+}
+
+// WithProxy sets the function that chooses the HTTP proxy, if any, that
+// DialWebSocket connects through, as in http.Transport. It is given a request
+// for the server's URL with the scheme changed from ws to http, or from wss
+// to https. By default, proxies are taken from the environment with
+// http.ProxyFromEnvironment; a nil function always connects directly.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) Option {
+	return func(o *options) {
+		o.proxy = proxy
+	}
+}
+
+// WithConn makes Dial and Connect use conn as the RPC connection instead of
+// dialing one. The handshake is still performed over conn.
+func WithConn(conn net.Conn) Option {
+	return func(o *options) {
+		o.conn = conn
+	}
+}
+
+// WithStreamConn makes Dial and DialStream use conn as the stream connection
+// instead of dialing one.
+func WithStreamConn(conn net.Conn) Option {
+	return func(o *options) {
+		o.streamConn = conn
+	}
+}
+
+// WithStream sets whether Dial opens a stream connection. Without one,
+// streams and events cannot be added. It is opened by default.
+func WithStream(enabled bool) Option {
+	return func(o *options) {
+		o.stream = enabled
+	}
+}
+
+// WithStreamAddr sets the address of the stream server that Dial connects to.
+// By default, Dial uses the port after the RPC server's port on the same host.
+func WithStreamAddr(addr string) Option {
+	return func(o *options) {
+		o.streamAddr = addr
+	}
+}
+
+// WithReconnect makes connections reconnect when they fail, waiting between
+// attempts as given by b. Calls in flight when the connection fails, and calls
+// made while reconnecting, return a SessionLostError.
+//
+// Object handles refer to objects of the lost session, so they should be
+// fetched again once calls succeed. Dial re-adds streams on the new session.
+// Streams whose calls refer to objects that no longer exist are closed, and so
+// are events, whose expressions always belong to the lost session; their Get
+// and Event.Wait methods then return a SessionLostError.
+//
+// Connections given with WithConn, WithStreamConn or NewConn are not
+// reconnected, since they cannot be dialed again.
+func WithReconnect(b Backoff) Option {
+	return func(o *options) {
+		o.reconnect = b
+	}
+}
+
+// dial opens a TCP connection to addr.
+func (o options) dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if o.dialer != nil {
+		d = *o.dialer
+	}
+	if o.keepAlive != 0 {
+		d.KeepAlive = o.keepAlive
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// defaultStreamAddr returns the conventional stream server address for the
+// RPC server at addr, which is on the next port.
+func defaultStreamAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", errors.Errorf("no default stream address for %s: port is not a number", addr)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+1)), nil
+}
@@ -0,0 +1,248 @@
+package krpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Backoff returns how long to wait before reconnection attempt n, counting
+// from zero, or false to give up reconnecting.
+type Backoff func(attempt int) (time.Duration, bool)
+
+// ExponentialBackoff waits initial before the first attempt, doubling the wait
+// after each failed attempt up to max. It gives up after attempts attempts, or
+// never if attempts is zero.
+func ExponentialBackoff(initial, max time.Duration, attempts int) Backoff {
+	return func(attempt int) (time.Duration, bool) {
+		if attempts > 0 && attempt >= attempts {
+			return 0, false
+		}
+		delay := initial
+		for i := 0; i < attempt && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			delay = max
+		}
+		return delay, true
+	}
+}
+
+// errNotDialed is the reason a stream connection given with WithStreamConn is
+// not reconnected.
+var errNotDialed = errors.New("stream connection was not dialed, so it cannot be dialed again")
+
+// errEventLost is the reason events end with their session: their expressions
+// are objects of the lost session, so they cannot be re-added.
+var errEventLost = errors.New("events cannot be re-added on a new session")
+
+// SessionLostError is returned by calls on a reconnecting connection that
+// failed. Objects, streams and events of the lost session no longer exist on
+// the server, and object handles should be fetched again.
+type SessionLostError struct {
+	// Err is the error that ended the session.
+	Err error
+}
+
+func (e *SessionLostError) Error() string {
+	return "session lost: " + e.Err.Error()
+}
+
+// Cause returns the error that ended the session, for use with errors.Cause.
+func (e *SessionLostError) Cause() error {
+	return e.Err
+}
+
+// IsSessionLost reports whether err is, or was caused by, a SessionLostError.
+func IsSessionLost(err error) bool {
+	for err != nil {
+		if _, ok := err.(*SessionLostError); ok {
+			return true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+	return false
+}
+
+// setOnReconnect sets fn to be called when the connection has reconnected,
+// with a nil error, or has given up reconnecting.
+func (c *Conn) setOnReconnect(fn func(err error)) {
+	c.calls.mu.Lock()
+	defer c.calls.mu.Unlock()
+
+	c.onReconnect = fn
+}
+
+// reconnect redials the connection until it succeeds, the backoff gives up,
+// or the connection is closed.
+func (c *Conn) reconnect() {
+	var err error
+	for attempt := 0; ; attempt++ {
+		delay, ok := c.opts.reconnect(attempt)
+		if !ok {
+			c.log.Log(LevelError, "reconnecting failed", Field{"addr", c.addr}, Field{"attempts", attempt}, Field{"error", err})
+			c.reconnected(errors.Wrap(err, "reconnect"))
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.closing:
+			return
+		}
+
+		var next *Conn
+		next, err = c.redial(context.Background())
+		if err != nil {
+			c.log.Log(LevelWarn, "reconnect attempt failed", Field{"addr", c.addr}, Field{"attempt", attempt}, Field{"error", err})
+			continue
+		}
+		if !c.replace(next) {
+			next.conn.Close()
+			return
+		}
+		c.log.Log(LevelInfo, "reconnected", Field{"addr", c.addr}, Field{"attempts", attempt + 1})
+		c.reconnected(nil)
+		return
+	}
+}
+
+// replace replaces the failed connection with next, and starts reading
+// responses from it. It reports false if the connection has been closed.
+func (c *Conn) replace(next *Conn) bool {
+	c.calls.writeMu.Lock()
+	defer c.calls.writeMu.Unlock()
+	c.calls.mu.Lock()
+	defer c.calls.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.conn = next.conn
+	c.frames = next.frames
+	c.id = next.id
+	c.calls.err = nil
+	c.calls.pending = nil
+	go c.readResponses()
+	return true
+}
+
+// reconnecting reports whether the connection has failed and is being
+// reconnected.
+func (c *Conn) reconnecting() bool {
+	c.calls.mu.Lock()
+	defer c.calls.mu.Unlock()
+
+	_, lost := c.calls.err.(*SessionLostError)
+	return lost && !c.closed
+}
+
+func (c *Conn) reconnected(err error) {
+	c.calls.mu.Lock()
+	fn := c.onReconnect
+	c.calls.mu.Unlock()
+
+	if fn != nil {
+		fn(err)
+	}
+}
+
+// restore reconnects the stream connection of a client whose RPC connection
+// has reconnected, and re-adds its streams.
+func (c *Client) restore(dialStream func(ctx context.Context, id []byte) (*Conn, error), err error) {
+	if c.Stream == nil {
+		return
+	}
+	if err != nil {
+		c.Stream.fail(&SessionLostError{Err: err})
+		return
+	}
+
+	conn, err := dialStream(context.Background(), c.conn.ID())
+	if err != nil {
+		c.conn.log.Log(LevelError, "reconnecting stream connection failed", Field{"error", err})
+		c.Stream.fail(&SessionLostError{Err: err})
+		return
+	}
+	if !c.Stream.replace(conn) {
+		return
+	}
+
+	for _, s := range c.Stream.tracked() {
+		s.restore()
+	}
+}
+
+// redialStream replaces the stream connection lost, which failed with err,
+// retrying with the reconnect backoff. If the RPC connection has failed too,
+// restore replaces the stream connection once it has reconnected instead.
+func (c *Client) redialStream(dialStream func(ctx context.Context, id []byte) (*Conn, error), lost *Conn, err error) {
+	for attempt := 0; ; attempt++ {
+		if c.conn.reconnecting() {
+			return
+		}
+		delay, ok := c.conn.opts.reconnect(attempt)
+		if !ok {
+			c.conn.log.Log(LevelError, "reconnecting stream connection failed", Field{"attempts", attempt}, Field{"error", err})
+			if c.Stream.current(lost) && !c.conn.reconnecting() {
+				c.Stream.fail(&SessionLostError{Err: err})
+			}
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.Stream.Done():
+			return
+		}
+		if !c.Stream.current(lost) || c.conn.reconnecting() {
+			return
+		}
+
+		var conn *Conn
+		conn, err = dialStream(context.Background(), c.conn.ID())
+		if err != nil {
+			c.conn.log.Log(LevelWarn, "stream reconnect attempt failed", Field{"attempt", attempt}, Field{"error", err})
+			continue
+		}
+		if !c.Stream.resume(lost, conn) {
+			conn.Close()
+			return
+		}
+		c.conn.log.Log(LevelInfo, "stream reconnected", Field{"attempts", attempt + 1})
+		return
+	}
+}
+
+// restore re-adds the stream after reconnecting, or closes it with a
+// SessionLostError if it cannot be re-added, as events cannot.
+func (s *Stream) restore() {
+	s.mu.Lock()
+	started, rate := s.started, s.rate
+	s.mu.Unlock()
+
+	k := s.k
+	id, err := uint64(0), errEventLost
+	if s.call != nil {
+		id, err = k.addStream(context.Background(), s.call, started)
+	}
+	if err == nil && rate != 0 {
+		err = k.SetStreamRate(id, rate)
+	}
+	if err != nil {
+		k.conn.log.Log(LevelWarn, "removing stream after reconnecting",
+			Field{"service", s.call.GetService()}, Field{"procedure", s.call.GetProcedure()}, Field{"error", err})
+		k.stream.untrack(s)
+		s.close(&SessionLostError{Err: err})
+		return
+	}
+
+	s.mu.Lock()
+	s.id = id
+	s.mu.Unlock()
+	k.stream.Subscribe(id, s.handle)
+}
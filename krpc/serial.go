@@ -0,0 +1,106 @@
+package krpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// NewConn makes an RPC connection over rwc, such as a serial port, performing
+// the same handshake as Connect. The SerialIO server speaks the TCP protocol
+// over a serial port, but has no stream server.
+//
+// If rwc has SetDeadline and SetWriteDeadline methods, as *os.File does,
+// contexts can interrupt calls that are blocked writing to it. Closing the
+// connection closes rwc.
+func NewConn(rwc io.ReadWriteCloser, opts ...Option) (*Conn, error) {
+	return NewConnContext(context.Background(), rwc, opts...)
+}
+
+// NewConnContext is like NewConn, but gives up on the handshake when ctx is
+// done.
+func NewConnContext(ctx context.Context, rwc io.ReadWriteCloser, opts ...Option) (*Conn, error) {
+	o := newOptions(opts)
+	conn := rwcConn{rwc}
+	c := newConn(conn, newVarintFramer(conn), "", o)
+	err := c.handshake(ctx, pb.ConnectionRequest{
+		Type:             pb.ConnectionRequest_RPC,
+		ClientName:       o.clientName,
+		ClientIdentifier: []byte{},
+	})
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialSerial opens the serial port device at baud bits per second and
+// connects to the kRPC SerialIO server on it. The client has no stream
+// connection, since the SerialIO server does not support streams.
+func DialSerial(device string, baud int, opts ...Option) (*Client, error) {
+	return DialSerialContext(context.Background(), device, baud, opts...)
+}
+
+// DialSerialContext is like DialSerial, but gives up on the handshake when ctx
+// is done.
+func DialSerialContext(ctx context.Context, device string, baud int, opts ...Option) (*Client, error) {
+	var connectSerial func(ctx context.Context) (*Conn, error)
+	connectSerial = func(ctx context.Context) (*Conn, error) {
+		port, err := openSerial(device, baud)
+		if err != nil {
+			return nil, err
+		}
+		c, err := NewConnContext(ctx, port, opts...)
+		if err != nil {
+			return nil, err
+		}
+		c.addr = device
+		c.redial = connectSerial
+		return c, nil
+	}
+
+	conn, err := connectSerial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, nil, newOptions(opts), nil), nil
+}
+
+// rwcConn adapts an io.ReadWriteCloser to a net.Conn. Deadlines are applied
+// if the underlying value supports them, and otherwise ignored.
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+func (c rwcConn) LocalAddr() net.Addr  { return rwcAddr{} }
+func (c rwcConn) RemoteAddr() net.Addr { return rwcAddr{} }
+
+func (c rwcConn) SetDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c rwcConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c rwcConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+type rwcAddr struct{}
+
+func (rwcAddr) Network() string { return "rwc" }
+func (rwcAddr) String() string  { return "rwc" }
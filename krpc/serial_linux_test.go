@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package krpc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// openPty opens a pseudoterminal pair, returning its master and the path of
+// its slave device. The caller closes the master.
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pseudoterminals: %v", err)
+	}
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		t.Fatalf("unlock pty: %v", err)
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		t.Fatalf("get pty number: %v", err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// serveSerial answers the handshake and GetStatus calls of a client on the
+// other end of master, as the SerialIO server would.
+func serveSerial(master *os.File, done chan<- error) {
+	r := bufio.NewReader(master)
+	write := func(msg proto.Message) error {
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		_, err = master.Write(append(proto.EncodeVarint(uint64(len(data))), data...))
+		return err
+	}
+
+	data, err := readFrame(r)
+	if err != nil {
+		done <- err
+		return
+	}
+	req := pb.ConnectionRequest{}
+	if err := proto.Unmarshal(data, &req); err != nil {
+		done <- err
+		return
+	}
+	if req.GetType() != pb.ConnectionRequest_RPC || req.GetClientName() != "serial" {
+		done <- fmt.Errorf("got connection request %v", &req)
+		return
+	}
+	if err := write(&pb.ConnectionResponse{Status: pb.ConnectionResponse_OK, ClientIdentifier: []byte{1}}); err != nil {
+		done <- err
+		return
+	}
+	done <- nil
+
+	for {
+		data, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		req := pb.Request{}
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return
+		}
+		status, _ := EncodeMessage(&pb.Status{Version: "serial"})
+		if err := write(&pb.Response{Results: []*pb.ProcedureResult{{Value: status}}}); err != nil {
+			return
+		}
+	}
+}
+
+func TestDialSerial(t *testing.T) {
+	master, path := openPty(t)
+	defer master.Close()
+	done := make(chan error, 1)
+	go serveSerial(master, done)
+
+	c, err := DialSerial(path, 115200, WithClientName("serial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := c.KRPC.GetStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.GetVersion() != "serial" {
+		t.Errorf("got version %q, want serial", status.GetVersion())
+	}
+}
+
+func TestOpenSerialTermios(t *testing.T) {
+	master, path := openPty(t)
+	defer master.Close()
+
+	port, err := openSerial(path, 57600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	var termios syscall.Termios
+	if err := ioctl(port, syscall.TCGETS, unsafe.Pointer(&termios)); err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&(syscall.ICANON|syscall.ECHO|syscall.ISIG) != 0 {
+		t.Errorf("local flags %#o are not raw", termios.Lflag)
+	}
+	if termios.Oflag&syscall.OPOST != 0 {
+		t.Errorf("output flags %#o post-process output", termios.Oflag)
+	}
+	if termios.Iflag&(syscall.ICRNL|syscall.IXON) != 0 {
+		t.Errorf("input flags %#o translate input", termios.Iflag)
+	}
+	if termios.Cflag&syscall.CSIZE != syscall.CS8 || termios.Cflag&(syscall.PARENB|syscall.CSTOPB) != 0 {
+		t.Errorf("control flags %#o are not 8N1", termios.Cflag)
+	}
+	if termios.Cflag&cbaud != syscall.B57600 {
+		t.Errorf("baud bits %#o, want %#o", termios.Cflag&cbaud, syscall.B57600)
+	}
+	if termios.Cc[syscall.VMIN] != 1 || termios.Cc[syscall.VTIME] != 0 {
+		t.Errorf("VMIN %d, VTIME %d, want 1, 0", termios.Cc[syscall.VMIN], termios.Cc[syscall.VTIME])
+	}
+
+	if _, err := openSerial(path, 12345); err == nil {
+		t.Errorf("opened with an unsupported baud rate")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package krpc
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// openSerial is only implemented on Linux.
+func openSerial(device string, baud int) (*os.File, error) {
+	return nil, errors.New("serial ports are only supported on Linux")
+}
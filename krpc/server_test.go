@@ -0,0 +1,251 @@
+package krpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// testClientID is the identifier the test server gives its client.
+var testClientID = []byte("test client")
+
+// testServer is a fake kRPC server for one client at a time. It answers the
+// handshakes of the RPC and stream servers, answers each call with the
+// handler registered for its procedure, and sends updates to the stream
+// connection.
+type testServer struct {
+	rpc    net.Listener
+	stream net.Listener
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	handlers map[string]func(*pb.ProcedureCall) *pb.ProcedureResult
+	conns    []net.Conn
+	name     string
+	updates  net.Conn
+	// connected is signaled when a stream connection is made.
+	connected *sync.Cond
+}
+
+func newTestServer(t *testing.T) *testServer {
+	rpc, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		rpc.Close()
+		t.Fatal(err)
+	}
+	s := testServer{
+		rpc:      rpc,
+		stream:   stream,
+		handlers: make(map[string]func(*pb.ProcedureCall) *pb.ProcedureResult),
+	}
+	s.connected = sync.NewCond(&s.mu)
+	s.wg.Add(2)
+	go s.serve(rpc, s.serveRPC)
+	go s.serve(stream, s.serveStream)
+	return &s
+}
+
+// Addr and StreamAddr return the addresses of the RPC and stream servers.
+func (s *testServer) Addr() string       { return s.rpc.Addr().String() }
+func (s *testServer) StreamAddr() string { return s.stream.Addr().String() }
+
+// Close stops the server and closes its connections.
+func (s *testServer) Close() {
+	s.rpc.Close()
+	s.stream.Close()
+	s.disconnect()
+	s.wg.Wait()
+}
+
+// disconnect closes the connections made so far, as a server restarting
+// would, but keeps listening for new ones.
+func (s *testServer) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	s.updates = nil
+}
+
+// disconnectStreams closes the stream connection, leaving the RPC
+// connections open.
+func (s *testServer) disconnectStreams() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.updates != nil {
+		s.updates.Close()
+		s.updates = nil
+	}
+}
+
+// handle registers h to answer calls to service.procedure.
+func (s *testServer) handle(service, procedure string, h func(*pb.ProcedureCall) *pb.ProcedureResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[service+"."+procedure] = h
+}
+
+// clientName returns the name of the last client to connect.
+func (s *testServer) clientName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.name
+}
+
+// update sends update to the stream connection, once it has been made.
+func (s *testServer) update(update *pb.StreamUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.updates == nil {
+		s.connected.Wait()
+	}
+	return writeTestMessage(s.updates, update)
+}
+
+// dial connects a client to srv.
+func dial(t *testing.T, srv *testServer, opts ...Option) *Client {
+	t.Helper()
+	opts = append([]Option{WithStreamAddr(srv.StreamAddr())}, opts...)
+	c, err := Dial(srv.Addr(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (s *testServer) serve(l net.Listener, handle func(net.Conn)) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+func (s *testServer) serveRPC(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req := pb.ConnectionRequest{}
+	if err := readTestMessage(r, &req); err != nil {
+		return
+	}
+	if req.GetType() != pb.ConnectionRequest_RPC {
+		writeTestMessage(conn, &pb.ConnectionResponse{Status: pb.ConnectionResponse_WRONG_TYPE})
+		return
+	}
+	s.mu.Lock()
+	s.name = req.GetClientName()
+	s.mu.Unlock()
+	writeTestMessage(conn, &pb.ConnectionResponse{
+		Status:           pb.ConnectionResponse_OK,
+		ClientIdentifier: testClientID,
+	})
+
+	for {
+		req := pb.Request{}
+		if err := readTestMessage(r, &req); err != nil {
+			return
+		}
+		res := pb.Response{}
+		for _, call := range req.GetCalls() {
+			res.Results = append(res.Results, s.call(call))
+		}
+		if err := writeTestMessage(conn, &res); err != nil {
+			return
+		}
+	}
+}
+
+func (s *testServer) call(call *pb.ProcedureCall) *pb.ProcedureResult {
+	s.mu.Lock()
+	h, ok := s.handlers[call.GetService()+"."+call.GetProcedure()]
+	s.mu.Unlock()
+
+	if !ok {
+		return &pb.ProcedureResult{Error: &pb.Error{
+			Service:     "KRPC",
+			Name:        "InvalidOperationException",
+			Description: fmt.Sprintf("Procedure not found: %s.%s", call.GetService(), call.GetProcedure()),
+		}}
+	}
+	return h(call)
+}
+
+func (s *testServer) serveStream(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req := pb.ConnectionRequest{}
+	if err := readTestMessage(r, &req); err != nil {
+		return
+	}
+	if req.GetType() != pb.ConnectionRequest_STREAM || !bytes.Equal(req.GetClientIdentifier(), testClientID) {
+		writeTestMessage(conn, &pb.ConnectionResponse{Status: pb.ConnectionResponse_MALFORMED_MESSAGE})
+		return
+	}
+
+	s.mu.Lock()
+	writeTestMessage(conn, &pb.ConnectionResponse{Status: pb.ConnectionResponse_OK})
+	s.updates = conn
+	s.connected.Broadcast()
+	s.mu.Unlock()
+
+	io.Copy(ioutil.Discard, r)
+
+	s.mu.Lock()
+	if s.updates == conn {
+		s.updates = nil
+	}
+	s.mu.Unlock()
+}
+
+func readTestMessage(r *bufio.Reader, msg proto.Message) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	return proto.Unmarshal(buf, msg)
+}
+
+func writeTestMessage(w io.Writer, msg proto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(proto.EncodeVarint(uint64(len(data))), data...))
+	return err
+}
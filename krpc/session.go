@@ -0,0 +1,360 @@
+package krpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// A session file records the messages sent and received by a client, one
+// JSON-encoded SessionEntry per line. Sessions are recorded with WithRecorder
+// and replayed with Session.Conn and Session.StreamConn:
+//
+//	session, err := krpc.ReadSession(f)
+//	...
+//	c, err := krpc.Dial("replay",
+//		krpc.WithConn(session.Conn(krpc.ReplayInOrder)),
+//		krpc.WithStreamConn(session.StreamConn()),
+//	)
+
+// SessionEntry is a message sent or received by a client.
+type SessionEntry struct {
+	Time time.Time `json:"time"`
+	// Conn is "rpc" or "stream".
+	Conn string `json:"conn"`
+	// Dir is "send" or "recv".
+	Dir string `json:"dir"`
+	// Type is the protobuf name of the message, such as "krpc.schema.Request".
+	Type string `json:"type"`
+	// Data is the encoded message.
+	Data []byte `json:"data"`
+}
+
+// Recorder writes the messages of connections to a session file. It is safe
+// for concurrent use.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewRecorder returns a recorder that writes to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error writing the session file, if any. Messages are
+// not recorded after an error.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+func (r *Recorder) record(conn, dir string, msg proto.Message, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(SessionEntry{
+		Time: time.Now(),
+		Conn: conn,
+		Dir:  dir,
+		Type: proto.MessageName(msg),
+		Data: data,
+	})
+}
+
+// ReplayMode is how a replayed connection chooses the response to a request.
+type ReplayMode int
+
+const (
+	// ReplayInOrder answers requests with the recorded responses in order,
+	// regardless of the requests.
+	ReplayInOrder ReplayMode = iota
+	// ReplayMatching answers each request with the response to the first
+	// unused recorded request with the same calls and arguments, and with an
+	// error if there is none. The handshake is answered with the recorded
+	// one.
+	ReplayMatching
+)
+
+// Session is a recorded session, which can be replayed.
+type Session struct {
+	Entries []SessionEntry
+
+	mu sync.Mutex
+	// last is the progress of the connection last returned by Conn, and
+	// next the progress for the next one if a stream connection is waiting
+	// for it.
+	last, next *replayProgress
+}
+
+// replayProgress counts the responses sent by a replayed RPC connection.
+type replayProgress struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	served int
+}
+
+func newReplayProgress() *replayProgress {
+	p := &replayProgress{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// ReadSession reads a session file.
+func ReadSession(r io.Reader) (*Session, error) {
+	var s Session
+	dec := json.NewDecoder(r)
+	for {
+		var entry SessionEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = append(s.Entries, entry)
+	}
+	return &s, nil
+}
+
+// Conn returns a connection that replays the session's RPC connection, from
+// the handshake onwards. When the recorded responses run out, the connection
+// is closed. Each connection replays the session from the start.
+func (s *Session) Conn(mode ReplayMode) net.Conn {
+	// The server answers requests in order, so each response answers the
+	// earliest request sent before it that is still unanswered.
+	var exchanges []replayExchange
+	var pending [][]byte
+	for _, e := range s.Entries {
+		if e.Conn != "rpc" {
+			continue
+		}
+		if e.Dir == "send" {
+			pending = append(pending, e.Data)
+			continue
+		}
+		x := replayExchange{response: e.Data}
+		if len(pending) > 0 {
+			x.request = pending[0]
+			pending = pending[1:]
+		}
+		exchanges = append(exchanges, x)
+	}
+
+	s.mu.Lock()
+	progress := s.next
+	if progress == nil {
+		progress = newReplayProgress()
+	}
+	s.last, s.next = progress, nil
+	s.mu.Unlock()
+
+	client, server := net.Pipe()
+	go replayRPC(server, progress, mode, exchanges)
+	return client
+}
+
+// replayExchange is a recorded response and the request it answered.
+type replayExchange struct {
+	request, response []byte
+}
+
+// StreamConn returns a connection that replays the session's stream
+// connection. Each stream update is sent once the RPC connection last
+// returned by Conn, or the next one if Conn has not been called, has sent as
+// many responses as had been received before the update was recorded, so
+// that updates are replayed deterministically.
+func (s *Session) StreamConn() net.Conn {
+	var handshake []byte
+	var updates [][]byte
+	var after []int
+	responses := 0
+	for _, e := range s.Entries {
+		switch {
+		case e.Conn == "rpc" && e.Dir == "recv":
+			responses++
+		case e.Conn == "stream" && e.Dir == "recv" && handshake == nil:
+			handshake = e.Data
+		case e.Conn == "stream" && e.Dir == "recv":
+			updates = append(updates, e.Data)
+			after = append(after, responses)
+		}
+	}
+
+	s.mu.Lock()
+	progress := s.last
+	if progress == nil {
+		if s.next == nil {
+			s.next = newReplayProgress()
+		}
+		progress = s.next
+	}
+	s.mu.Unlock()
+
+	client, server := net.Pipe()
+	go replayStream(server, progress, handshake, updates, after)
+	return client
+}
+
+func replayRPC(conn net.Conn, progress *replayProgress, mode ReplayMode, exchanges []replayExchange) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	used := make([]bool, len(exchanges))
+	next := 0
+	for {
+		req, err := readFrame(r)
+		if err != nil {
+			return
+		}
+
+		var res []byte
+		switch {
+		case mode == ReplayInOrder || next == 0:
+			// The handshake is always answered first, whatever the client
+			// name in it.
+			if next >= len(exchanges) {
+				return
+			}
+			res = exchanges[next].response
+			used[next] = true
+			next++
+		case mode == ReplayMatching:
+			for i, x := range exchanges {
+				if !used[i] && sameRequest(x.request, req) {
+					used[i] = true
+					res = x.response
+					break
+				}
+			}
+			if res == nil {
+				res, _ = proto.Marshal(&pb.Response{Error: &pb.Error{
+					Description: "no recorded response matches the request",
+				}})
+			}
+		}
+
+		_, err = conn.Write(append(proto.EncodeVarint(uint64(len(res))), res...))
+		if err != nil {
+			return
+		}
+		progress.mu.Lock()
+		progress.served++
+		progress.cond.Broadcast()
+		progress.mu.Unlock()
+	}
+}
+
+// sameRequest reports whether the encoded requests a and b make the same
+// calls with the same arguments, however they are encoded.
+func sameRequest(a, b []byte) bool {
+	var reqA, reqB pb.Request
+	if proto.Unmarshal(a, &reqA) != nil || proto.Unmarshal(b, &reqB) != nil {
+		return false
+	}
+	if len(reqA.GetCalls()) != len(reqB.GetCalls()) {
+		return false
+	}
+	for i, callA := range reqA.GetCalls() {
+		callB := reqB.GetCalls()[i]
+		if callA.GetService() != callB.GetService() || callA.GetProcedure() != callB.GetProcedure() {
+			return false
+		}
+		if !sameArguments(callA.GetArguments(), callB.GetArguments()) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameArguments reports whether a and b give the same values at the same
+// positions, in any order.
+func sameArguments(a, b []*pb.Argument) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	values := make(map[uint32][]byte, len(a))
+	for _, arg := range a {
+		values[arg.GetPosition()] = arg.GetValue()
+	}
+	for _, arg := range b {
+		value, ok := values[arg.GetPosition()]
+		if !ok || !bytes.Equal(value, arg.GetValue()) {
+			return false
+		}
+	}
+	return true
+}
+
+func replayStream(conn net.Conn, progress *replayProgress, handshake []byte, updates [][]byte, after []int) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	if _, err := readFrame(r); err != nil || handshake == nil {
+		return
+	}
+
+	// Stop waiting for the RPC connection when the client disconnects.
+	closed := false
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		progress.mu.Lock()
+		closed = true
+		progress.cond.Broadcast()
+		progress.mu.Unlock()
+	}()
+
+	messages := append([][]byte{handshake}, updates...)
+	after = append([]int{0}, after...)
+	for i, msg := range messages {
+		progress.mu.Lock()
+		for progress.served < after[i] && !closed {
+			progress.cond.Wait()
+		}
+		stop := closed
+		progress.mu.Unlock()
+		if stop {
+			return
+		}
+
+		_, err := conn.Write(append(proto.EncodeVarint(uint64(len(msg))), msg...))
+		if err != nil {
+			return
+		}
+	}
+
+	// Keep the connection open, as the server would.
+	progress.mu.Lock()
+	for !closed {
+		progress.cond.Wait()
+	}
+	progress.mu.Unlock()
+}
+
+// readFrame reads a varint-delimited message.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
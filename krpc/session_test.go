@@ -0,0 +1,201 @@
+package krpc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// recordSession records a client echoing "a" and "b", then adding a stream
+// of UT and receiving an update of it to 5.
+func recordSession(t *testing.T) []byte {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	calls := make(chan string, 10)
+	handleStreams(srv, calls)
+
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	c := dial(t, srv, WithRecorder(rec))
+	defer c.Close()
+	for _, s := range []string{"a", "b"} {
+		if _, err := echo(context.Background(), c, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "SpaceCenter", Procedure: "get_UT"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut := s.AsFloat64()
+	if err := srv.update(streamUpdate(s.ID(), EncodeFloat64(5))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ut.Updates():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update while recording")
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// replay connects a client to a replay of the recorded session.
+func replay(t *testing.T, recorded []byte, mode ReplayMode) *Client {
+	t.Helper()
+	session, err := ReadSession(bytes.NewReader(recorded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Dial("replay", WithConn(session.Conn(mode)), WithStreamConn(session.StreamConn()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReplayInOrder(t *testing.T) {
+	recorded := recordSession(t)
+	c := replay(t, recorded, ReplayInOrder)
+	defer c.Close()
+
+	// The recorded responses are replayed regardless of the requests.
+	for _, want := range []string{"a", "b"} {
+		if got, err := echo(context.Background(), c, "x"); err != nil || got != want {
+			t.Errorf("got %q, %v, want %q", got, err, want)
+		}
+	}
+	s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "SpaceCenter", Procedure: "get_UT"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-s.AsFloat64().Updates():
+		if v != 5 {
+			t.Errorf("got update %v, want 5", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update replayed")
+	}
+
+	// The connection closes when the responses run out.
+	if _, err := echo(context.Background(), c, "c"); err == nil {
+		t.Error("call succeeded after the recorded responses ran out")
+	}
+}
+
+func TestReplayMatching(t *testing.T) {
+	recorded := recordSession(t)
+	c := replay(t, recorded, ReplayMatching)
+	defer c.Close()
+
+	// Requests are answered by their recorded response, in any order.
+	for _, want := range []string{"b", "a"} {
+		if got, err := echo(context.Background(), c, want); err != nil || got != want {
+			t.Errorf("got %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := echo(context.Background(), c, "c"); err == nil {
+		t.Error("call without a recorded response succeeded")
+	}
+	if _, err := echo(context.Background(), c, "a"); err == nil {
+		t.Error("recorded response answered a second request")
+	}
+}
+
+// sessionEntry returns a recorded RPC message.
+func sessionEntry(t *testing.T, dir string, msg proto.Message) SessionEntry {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SessionEntry{Conn: "rpc", Dir: dir, Type: proto.MessageName(msg), Data: data}
+}
+
+// sumCall calls Test.Sum with arguments a and b, in the given order.
+func sumCall(a, b *pb.Argument) *pb.Request {
+	return &pb.Request{Calls: []*pb.ProcedureCall{{
+		Service:   "Test",
+		Procedure: "Sum",
+		Arguments: []*pb.Argument{a, b},
+	}}}
+}
+
+func TestReplayMatchingPipelined(t *testing.T) {
+	one := &pb.Argument{Position: 0, Value: EncodeInt32(1)}
+	two := &pb.Argument{Position: 1, Value: EncodeInt32(2)}
+	three := &pb.Argument{Position: 1, Value: EncodeInt32(3)}
+	result := func(v int32) *pb.Response {
+		return &pb.Response{Results: []*pb.ProcedureResult{{Value: EncodeInt32(v)}}}
+	}
+
+	// Both requests were sent before either response was received.
+	session := &Session{Entries: []SessionEntry{
+		sessionEntry(t, "send", &pb.ConnectionRequest{Type: pb.ConnectionRequest_RPC, ClientName: "recorded"}),
+		sessionEntry(t, "recv", &pb.ConnectionResponse{Status: pb.ConnectionResponse_OK, ClientIdentifier: testClientID}),
+		sessionEntry(t, "send", sumCall(one, two)),
+		sessionEntry(t, "send", sumCall(one, three)),
+		sessionEntry(t, "recv", result(3)),
+		sessionEntry(t, "recv", result(4)),
+	}}
+	c, err := Dial("replay", WithConn(session.Conn(ReplayMatching)), WithStream(false), WithClientName("replayed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Arguments match whatever their order.
+	for _, tt := range []struct {
+		call *pb.ProcedureCall
+		want int32
+	}{
+		{sumCall(three, one).Calls[0], 4},
+		{sumCall(two, one).Calls[0], 3},
+	} {
+		b, err := c.conn.Invoke(context.Background(), tt.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := DecodeInt32(b); err != nil || got != tt.want {
+			t.Errorf("got %v, %v, want %v", got, err, tt.want)
+		}
+	}
+}
+
+func TestReplayTwice(t *testing.T) {
+	session, err := ReadSession(bytes.NewReader(recordSession(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each pair of connections replays the session from the start.
+	for i := 0; i < 2; i++ {
+		c, err := Dial("replay", WithConn(session.Conn(ReplayInOrder)), WithStreamConn(session.StreamConn()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"a", "b"} {
+			if got, err := echo(context.Background(), c, want); err != nil || got != want {
+				t.Errorf("replay %d: got %q, %v, want %q", i, got, err, want)
+			}
+		}
+		s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "SpaceCenter", Procedure: "get_UT"}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-s.AsFloat64().Updates():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("replay %d: no update replayed", i)
+		}
+		c.Close()
+	}
+}
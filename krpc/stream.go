@@ -1,9 +1,264 @@
 package krpc
 
-import "errors"
+import (
+	"context"
+	"sync"
 
-type StreamClient struct{}
+	"github.com/ilikebits/jeb/krpc/pb"
+)
 
-func DialStream(addr string) (*StreamClient, error) {
-	return nil, errors.New("not implemented")
+// StreamClient is a connection to the kRPC stream server. It reads
+// StreamUpdate messages in the background and dispatches each result to the
+// handler registered for its stream ID.
+type StreamClient struct {
+	conn *Conn
+
+	mu       sync.Mutex
+	handlers map[uint64]func(*pb.ProcedureResult)
+	latest   map[uint64]*pb.ProcedureResult
+	streams  map[*Stream]bool
+	err      error
+	done     chan struct{}
+	finish   sync.Once
+
+	// reconnect is set if the connection is replaced when it fails, rather
+	// than ending the stream client. onLost is called to replace a failed
+	// connection; without it, the stream client ends.
+	reconnect bool
+	onLost    func(conn *Conn, err error)
+	closed    bool
+}
+
+// DialStream opens a stream connection to addr on behalf of the RPC client
+// identified by id, which is the value of Conn.ID() for that client's RPC
+// connection.
+func DialStream(addr string, id []byte, opts ...Option) (*StreamClient, error) {
+	return DialStreamContext(context.Background(), addr, id, opts...)
+}
+
+// DialStreamContext is like DialStream, but gives up on connecting when ctx
+// is done. Once connected, ctx does not affect the stream connection.
+func DialStreamContext(ctx context.Context, addr string, id []byte, opts ...Option) (*StreamClient, error) {
+	o := newOptions(opts)
+	conn, err := connect(ctx, addr, streamRequest(id), o.streamConn, o)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamClient(conn, o), nil
+}
+
+// streamRequest returns the handshake for a stream connection on behalf of
+// the client identified by id.
+func streamRequest(id []byte) pb.ConnectionRequest {
+	return pb.ConnectionRequest{
+		Type:             pb.ConnectionRequest_STREAM,
+		ClientIdentifier: id,
+	}
+}
+
+// newStreamClient starts reading stream updates from conn.
+func newStreamClient(conn *Conn, o options) *StreamClient {
+	s := StreamClient{
+		conn:      conn,
+		handlers:  make(map[uint64]func(*pb.ProcedureResult)),
+		latest:    make(map[uint64]*pb.ProcedureResult),
+		streams:   make(map[*Stream]bool),
+		done:      make(chan struct{}),
+		reconnect: o.reconnect != nil,
+	}
+	go s.listen(conn)
+
+	return &s
+}
+
+// Subscribe registers fn to be called with every update for stream id. If an
+// update for the stream has already been received, fn is called immediately
+// with the most recent one, since the server may send the first value before
+// the caller has learned the stream's ID.
+//
+// Handlers are called from the stream client's read goroutine and must not
+// block.
+func (s *StreamClient) Subscribe(id uint64, fn func(*pb.ProcedureResult)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[id] = fn
+	if result, ok := s.latest[id]; ok {
+		fn(result)
+	}
+}
+
+// Unsubscribe removes the handler for stream id and forgets its last value.
+func (s *StreamClient) Unsubscribe(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.handlers, id)
+	delete(s.latest, id)
+}
+
+// Done returns a channel that is closed when the stream connection stops
+// receiving updates. A reconnecting client's stream connection stops only
+// when it is closed or reconnecting fails.
+func (s *StreamClient) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error that stopped the stream connection, if any.
+func (s *StreamClient) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *StreamClient) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	conn := s.conn
+	s.mu.Unlock()
+
+	s.stop()
+	return conn.Close()
+}
+
+func (s *StreamClient) listen(conn *Conn) {
+	for {
+		update := pb.StreamUpdate{}
+		err := conn.Read(&update)
+		if err != nil {
+			conn.log.Log(LevelInfo, "stream connection closed", Field{"error", err})
+			s.mu.Lock()
+			if s.conn != conn {
+				// The connection has already been replaced.
+				s.mu.Unlock()
+				return
+			}
+			s.err = err
+			stop := s.closed || !s.reconnect || s.onLost == nil
+			onLost := s.onLost
+			s.mu.Unlock()
+			if stop {
+				s.stop()
+				return
+			}
+			onLost(conn, err)
+			return
+		}
+
+		s.dispatch(&update)
+	}
+}
+
+// stop closes the Done channel.
+func (s *StreamClient) stop() {
+	s.finish.Do(func() {
+		close(s.done)
+	})
+}
+
+// setOnLost sets fn to be called from the read goroutine when conn fails,
+// to replace it.
+func (s *StreamClient) setOnLost(fn func(conn *Conn, err error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onLost = fn
+}
+
+// current reports whether conn is the stream client's connection.
+func (s *StreamClient) current(conn *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn == conn
+}
+
+// fail stops a reconnecting stream client that could not reconnect.
+func (s *StreamClient) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+
+	s.stop()
+}
+
+// replace replaces the connection of a reconnecting stream client whose RPC
+// connection has reconnected. Handlers and values of the old connection's
+// streams are discarded, since the streams belonged to the lost session.
+func (s *StreamClient) replace(conn *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	if s.conn != conn {
+		s.conn.Close()
+	}
+	s.conn = conn
+	s.err = nil
+	s.handlers = make(map[uint64]func(*pb.ProcedureResult))
+	s.latest = make(map[uint64]*pb.ProcedureResult)
+	go s.listen(conn)
+	return true
+}
+
+// resume replaces the failed connection lost of a reconnecting stream client
+// whose RPC connection is still connected. The streams belong to the RPC
+// session, so their handlers are kept. It reports false if the stream client
+// has been closed or lost has already been replaced.
+func (s *StreamClient) resume(lost, conn *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.conn != lost {
+		return false
+	}
+	s.conn = conn
+	s.err = nil
+	go s.listen(conn)
+	return true
+}
+
+// track records a stream to be re-added after reconnecting.
+func (s *StreamClient) track(stream *Stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streams[stream] = true
+}
+
+// untrack forgets a removed stream.
+func (s *StreamClient) untrack(stream *Stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, stream)
+}
+
+// tracked returns the streams that have not been removed.
+func (s *StreamClient) tracked() []*Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var streams []*Stream
+	for stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func (s *StreamClient) dispatch(update *pb.StreamUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, result := range update.GetResults() {
+		id := result.GetId()
+		s.latest[id] = result.GetResult()
+		if fn, ok := s.handlers[id]; ok {
+			fn(result.GetResult())
+		}
+	}
 }
@@ -0,0 +1,431 @@
+package krpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// handleStreams registers handlers for the KRPC stream procedures, which add
+// streams with IDs from 1 and send the name of each procedure called to
+// calls.
+func handleStreams(srv *testServer, calls chan<- string) {
+	var id uint64
+	srv.handle("KRPC", "AddStream", func(call *pb.ProcedureCall) *pb.ProcedureResult {
+		calls <- call.GetProcedure()
+		id++
+		b, _ := EncodeMessage(&pb.Stream{Id: id})
+		return &pb.ProcedureResult{Value: b}
+	})
+	for _, procedure := range []string{"StartStream", "SetStreamRate", "RemoveStream"} {
+		srv.handle("KRPC", procedure, func(call *pb.ProcedureCall) *pb.ProcedureResult {
+			calls <- call.GetProcedure()
+			return &pb.ProcedureResult{}
+		})
+	}
+}
+
+// streamUpdate returns an update of stream id to value.
+func streamUpdate(id uint64, value []byte) *pb.StreamUpdate {
+	return &pb.StreamUpdate{Results: []*pb.StreamResult{
+		{Id: id, Result: &pb.ProcedureResult{Value: value}},
+	}}
+}
+
+// expectCall fails the test unless the next call sent to calls is to
+// procedure.
+func expectCall(t *testing.T, calls <-chan string, procedure string) {
+	t.Helper()
+	select {
+	case got := <-calls:
+		if got != procedure {
+			t.Errorf("got call to %s, want %s", got, procedure)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no call to %s", procedure)
+	}
+}
+
+func TestStream(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	calls := make(chan string, 10)
+	handleStreams(srv, calls)
+	c := dial(t, srv)
+	defer c.Close()
+
+	s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "SpaceCenter", Procedure: "get_UT"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCall(t, calls, "AddStream")
+	ut := s.AsFloat64()
+	if err := ut.Start(); err != nil {
+		t.Fatal(err)
+	}
+	expectCall(t, calls, "StartStream")
+
+	if err := srv.update(streamUpdate(s.ID(), EncodeFloat64(1))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-ut.Updates():
+		if v != 1 {
+			t.Errorf("got update %v, want 1", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update")
+	}
+	if v, err := ut.Get(); err != nil || v != 1 {
+		t.Errorf("Get: got %v, %v, want 1", v, err)
+	}
+
+	// Handles made after an update start with its value.
+	if v, ok := <-s.AsFloat64().Updates(); !ok || v != 1 {
+		t.Errorf("new handle got %v, %v, want 1", v, ok)
+	}
+
+	if err := ut.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	expectCall(t, calls, "RemoveStream")
+	if _, ok := <-ut.Updates(); ok {
+		t.Error("updates not closed after Remove")
+	}
+}
+
+func TestEvent(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	calls := make(chan string, 10)
+	handleStreams(srv, calls)
+	// Expressions are given IDs in the order they are made, and events are
+	// streams of their expression's value.
+	var exprs []string
+	for _, procedure := range []string{"Call", "ConstantDouble", "GreaterThan"} {
+		srv.handle("KRPC", "Expression_static_"+procedure, func(call *pb.ProcedureCall) *pb.ProcedureResult {
+			exprs = append(exprs, call.GetProcedure())
+			return &pb.ProcedureResult{Value: EncodeObject(uint64(len(exprs)))}
+		})
+	}
+	srv.handle("KRPC", "AddEvent", func(call *pb.ProcedureCall) *pb.ProcedureResult {
+		id, err := DecodeObject(call.GetArguments()[0].GetValue())
+		if err != nil || id != 3 {
+			return &pb.ProcedureResult{Error: &pb.Error{Description: "event of the wrong expression"}}
+		}
+		b, _ := EncodeMessage(&pb.Event{Stream: &pb.Stream{Id: 10}})
+		return &pb.ProcedureResult{Value: b}
+	})
+	c := dial(t, srv)
+	defer c.Close()
+
+	static := c.KRPC.Expression()
+	altitude, err := static.Call(&pb.ProcedureCall{Service: "SpaceCenter", Procedure: "Flight_get_SurfaceAltitude"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit, err := static.ConstantDouble(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	above, err := static.GreaterThan(altitude, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := c.KRPC.AddEvent(above)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fired := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		fired <- event.Wait(ctx)
+	}()
+	expectCall(t, calls, "StartStream")
+	if err := srv.update(streamUpdate(event.ID(), EncodeBool(false))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-fired:
+		t.Fatalf("event fired while its expression was false: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := srv.update(streamUpdate(event.ID(), EncodeBool(true))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-fired; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.handle("KRPC", "Expression_static_ConstantBool", func(*pb.ProcedureCall) *pb.ProcedureResult {
+		return &pb.ProcedureResult{Value: EncodeObject(1)}
+	})
+	c := dial(t, srv)
+	defer c.Close()
+
+	static := c.KRPC.Expression()
+	expr, err := static.ConstantBool(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := static.And(nil, expr); err != ErrNilExpression {
+		t.Errorf("And: got %v, want %v", err, ErrNilExpression)
+	}
+	if _, err := static.Not(nil); err != ErrNilExpression {
+		t.Errorf("Not: got %v, want %v", err, ErrNilExpression)
+	}
+	if _, err := static.Cast(expr, nil); err != ErrNilExpression {
+		t.Errorf("Cast: got %v, want %v", err, ErrNilExpression)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := static.ConstantBoolContext(ctx, true); err != context.Canceled {
+		t.Errorf("ConstantBoolContext: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	calls := make(chan string, 10)
+	handleStreams(srv, calls)
+	c := dial(t, srv, WithReconnect(ExponentialBackoff(50*time.Millisecond, 100*time.Millisecond, 20)))
+	defer c.Close()
+
+	s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "SpaceCenter", Procedure: "get_UT"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCall(t, calls, "AddStream")
+	ut := s.AsFloat64()
+	id := s.ID()
+
+	srv.disconnect()
+
+	// Calls fail until the client has reconnected, with a lost session once
+	// the client has noticed the disconnection.
+	lost := false
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := echo(context.Background(), c, "hello")
+		if err == nil {
+			break
+		}
+		lost = lost || IsSessionLost(err)
+		if time.Now().After(deadline) {
+			t.Fatal("did not reconnect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !lost {
+		t.Error("no call failed with a lost session")
+	}
+
+	// The stream is re-added with a new ID, and its handles keep receiving
+	// its updates.
+	expectCall(t, calls, "AddStream")
+	for s.ID() == id {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream kept ID %d after reconnecting", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := srv.update(streamUpdate(s.ID(), EncodeFloat64(2))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-ut.Updates():
+		if v != 2 {
+			t.Errorf("got update %v, want 2", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update after reconnecting")
+	}
+}
+
+func TestReconnectStream(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	calls := make(chan string, 10)
+	handleStreams(srv, calls)
+	c := dial(t, srv, WithReconnect(ExponentialBackoff(10*time.Millisecond, 100*time.Millisecond, 20)))
+	defer c.Close()
+
+	s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "SpaceCenter", Procedure: "get_UT"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCall(t, calls, "AddStream")
+	ut := s.AsFloat64()
+
+	// Only the stream connection is redialed, so the session and its streams
+	// survive.
+	srv.disconnectStreams()
+	if err := srv.update(streamUpdate(s.ID(), EncodeFloat64(2))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-ut.Updates():
+		if v != 2 {
+			t.Errorf("got update %v, want 2", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update after redialing the stream connection")
+	}
+	select {
+	case procedure := <-calls:
+		t.Errorf("called %s after redialing the stream connection", procedure)
+	default:
+	}
+	select {
+	case <-c.Stream.Done():
+		t.Errorf("stream client stopped: %v", c.Stream.Err())
+	default:
+	}
+}
+
+func TestReconnectEvent(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	srv.handle("KRPC", "Expression_static_ConstantBool", func(*pb.ProcedureCall) *pb.ProcedureResult {
+		return &pb.ProcedureResult{Value: EncodeObject(1)}
+	})
+	srv.handle("KRPC", "AddEvent", func(*pb.ProcedureCall) *pb.ProcedureResult {
+		b, _ := EncodeMessage(&pb.Event{Stream: &pb.Stream{Id: 10}})
+		return &pb.ProcedureResult{Value: b}
+	})
+	c := dial(t, srv, WithReconnect(ExponentialBackoff(time.Millisecond, time.Millisecond, 0)))
+	defer c.Close()
+
+	expr, err := c.KRPC.Expression().ConstantBool(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := c.KRPC.AddEvent(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The event cannot be re-added, so it ends with the lost session.
+	srv.disconnect()
+	select {
+	case _, ok := <-event.Fired():
+		if ok {
+			t.Fatal("event fired after disconnecting")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event did not end after reconnecting")
+	}
+	if err := event.Wait(context.Background()); !IsSessionLost(err) {
+		t.Errorf("got %v, want a lost session", err)
+	}
+	if _, err := event.Get(); !IsSessionLost(err) {
+		t.Errorf("Get: got %v, want a lost session", err)
+	}
+}
+
+func TestReconnectGivenConn(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, srv, WithConn(conn), WithStream(false), WithReconnect(ExponentialBackoff(time.Millisecond, time.Millisecond, 0)))
+	defer c.Close()
+
+	// A connection that was not dialed is not dialed again, so the session
+	// ends.
+	srv.disconnect()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := echo(context.Background(), c, "hello")
+		if err != nil {
+			if IsSessionLost(err) {
+				t.Errorf("got %v, want an error without reconnecting", err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("call succeeded after disconnecting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := echo(context.Background(), c, "hello"); err == nil {
+		t.Error("call succeeded on a connection that was not dialed")
+	}
+}
+
+func TestStreamLostWithoutReconnect(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	handleEcho(srv)
+	c := dial(t, srv)
+	defer c.Close()
+
+	srv.disconnectStreams()
+	select {
+	case <-c.Stream.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream client did not stop")
+	}
+	if c.Stream.Err() == nil {
+		t.Error("stream client stopped without an error")
+	}
+
+	// The RPC connection stays open.
+	if got, err := echo(context.Background(), c, "hello"); err != nil || got != "hello" {
+		t.Errorf("got %q, %v, want hello", got, err)
+	}
+}
+
+func TestStreamGetRemoved(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	calls := make(chan string, 10)
+	handleStreams(srv, calls)
+	c := dial(t, srv)
+	defer c.Close()
+
+	s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "SpaceCenter", Procedure: "get_UT"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut := s.AsFloat64()
+
+	// Remove wakes a Get waiting for the first value.
+	got := make(chan error, 1)
+	go func() {
+		_, err := ut.Get()
+		got <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := ut.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-got:
+		if err != ErrStreamClosed {
+			t.Errorf("got error %v, want %v", err, ErrStreamClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get still waiting after Remove")
+	}
+	if _, err := ut.Get(); err != ErrStreamClosed {
+		t.Errorf("Get after Remove: got error %v, want %v", err, ErrStreamClosed)
+	}
+}
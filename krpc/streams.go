@@ -0,0 +1,396 @@
+package krpc
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+var (
+	// ErrNoStreamClient is returned when adding a stream to a client that has
+	// no stream connection.
+	ErrNoStreamClient = errors.New("no stream connection")
+
+	// ErrStreamClosed is returned when reading a stream whose connection has
+	// closed before a value was received, or which has been removed.
+	ErrStreamClosed = errors.New("stream closed")
+)
+
+// Stream is a handle to a procedure call registered as a stream on the server.
+// Its values are encoded; use a typed accessor such as AsFloat64 to decode them.
+type Stream struct {
+	k *KRPC
+
+	// call is the procedure call of the stream, for re-adding it after
+	// reconnecting. It is nil for events.
+	call *pb.ProcedureCall
+
+	mu        sync.Mutex
+	id        uint64
+	started   bool
+	rate      float32
+	result    *pb.ProcedureResult
+	ready     chan struct{}
+	listeners []streamListener
+	// err is set when the stream is closed: to ErrStreamClosed when it is
+	// removed, or to a SessionLostError when it cannot be re-added after
+	// reconnecting.
+	err error
+}
+
+type streamListener struct {
+	update func(value []byte)
+	close  func()
+}
+
+func newStream(k *KRPC, id uint64) *Stream {
+	return &Stream{
+		k:     k,
+		id:    id,
+		ready: make(chan struct{}),
+	}
+}
+
+// ID returns the server's ID for the stream. It changes when the stream is
+// re-added after reconnecting.
+func (s *Stream) ID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.id
+}
+
+// Get returns the most recent encoded value of the stream, waiting for the
+// first value if none has arrived yet. It returns ErrStreamClosed once the
+// stream has been removed, and a SessionLostError once it has been lost with
+// its session.
+func (s *Stream) Get() ([]byte, error) {
+	if err := s.closedErr(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-s.ready:
+	case <-s.k.stream.Done():
+		select {
+		case <-s.ready:
+		default:
+			return nil, ErrStreamClosed
+		}
+	}
+
+	s.mu.Lock()
+	result, err := s.result, s.err
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if e := result.GetError(); e != nil {
+		return nil, newError(e)
+	}
+	return result.GetValue(), nil
+}
+
+// Start starts a stream that was added with start set to false. It does
+// nothing if the stream has been started, and returns the error Get returns
+// if the stream has been closed.
+func (s *Stream) Start() error {
+	s.mu.Lock()
+	started, err := s.started, s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if started {
+		return nil
+	}
+
+	err = s.k.StartStream(s.ID())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+	return nil
+}
+
+// SetRate sets the update rate of the stream in Hz.
+func (s *Stream) SetRate(hz float32) error {
+	err := s.k.SetStreamRate(s.ID(), hz)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.rate = hz
+	s.mu.Unlock()
+	return nil
+}
+
+// Remove removes the stream from the server and closes the Updates channels of
+// its typed handles.
+func (s *Stream) Remove() error {
+	id := s.ID()
+	err := s.k.RemoveStream(id)
+	if err != nil {
+		return err
+	}
+	s.k.stream.Unsubscribe(id)
+	s.k.stream.untrack(s)
+	s.close(ErrStreamClosed)
+	return nil
+}
+
+// close closes the Updates channels of the stream's typed handles, and wakes
+// calls to Get waiting for a first value, which then return err.
+func (s *Stream) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+		if s.result == nil {
+			close(s.ready)
+		}
+		for _, l := range s.listeners {
+			l.close()
+		}
+		s.listeners = nil
+	}
+}
+
+// closedErr returns the error the stream was closed with, or nil if it is
+// open.
+func (s *Stream) closedErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// handle is called by the stream client for every update to the stream.
+func (s *Stream) handle(result *pb.ProcedureResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	if s.result == nil {
+		close(s.ready)
+	}
+	s.result = result
+	if result.GetError() != nil {
+		return
+	}
+	for _, l := range s.listeners {
+		l.update(result.GetValue())
+	}
+}
+
+// listen registers a typed handle's update and close callbacks, immediately
+// delivering the current value if there is one.
+func (s *Stream) listen(update func(value []byte), close func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		close()
+		return
+	}
+	s.listeners = append(s.listeners, streamListener{update: update, close: close})
+	if s.result != nil && s.result.GetError() == nil {
+		update(s.result.GetValue())
+	}
+}
+
+// Typed stream handles. Updates channels hold only the most recent value, so a
+// slow reader sees the latest value rather than a backlog; undecodable updates
+// are dropped, and Get reports the decoding error instead.
+
+// decodeFunc decodes a value of a typed handle.
+type decodeFunc func(value []byte) (interface{}, error)
+
+// listenDecoded registers a typed handle whose Updates channel is updates,
+// which must be a buffered channel of the values returned by decode.
+func (s *Stream) listenDecoded(updates interface{}, decode decodeFunc) {
+	ch := reflect.ValueOf(updates)
+	s.listen(func(value []byte) {
+		v, err := decode(value)
+		if err != nil {
+			return
+		}
+		ch.TryRecv()
+		ch.Send(reflect.ValueOf(v))
+	}, ch.Close)
+}
+
+// getDecoded returns the value that Get returns, decoded with decode.
+func (s *Stream) getDecoded(decode decodeFunc) (interface{}, error) {
+	value, err := s.Get()
+	if err != nil {
+		return nil, err
+	}
+	return decode(value)
+}
+
+// Decoders of the typed handles' values, as decodeFuncs.
+func decodeFloat64Value(b []byte) (interface{}, error)    { return DecodeFloat64(b) }
+func decodeFloat32Value(b []byte) (interface{}, error)    { return DecodeFloat32(b) }
+func decodeInt32Value(b []byte) (interface{}, error)      { return DecodeInt32(b) }
+func decodeBoolValue(b []byte) (interface{}, error)       { return DecodeBool(b) }
+func decodeStringValue(b []byte) (interface{}, error)     { return DecodeString(b) }
+func decodeVectorValue(b []byte) (interface{}, error)     { return DecodeVector(b) }
+func decodeQuaternionValue(b []byte) (interface{}, error) { return DecodeQuaternion(b) }
+
+type Float64Stream struct {
+	*Stream
+	updates chan float64
+}
+
+func (s *Stream) AsFloat64() *Float64Stream {
+	t := Float64Stream{Stream: s, updates: make(chan float64, 1)}
+	s.listenDecoded(t.updates, decodeFloat64Value)
+	return &t
+}
+
+func (s *Float64Stream) Get() (float64, error) {
+	v, err := s.getDecoded(decodeFloat64Value)
+	value, _ := v.(float64)
+	return value, err
+}
+
+func (s *Float64Stream) Updates() <-chan float64 {
+	return s.updates
+}
+
+type Float32Stream struct {
+	*Stream
+	updates chan float32
+}
+
+func (s *Stream) AsFloat32() *Float32Stream {
+	t := Float32Stream{Stream: s, updates: make(chan float32, 1)}
+	s.listenDecoded(t.updates, decodeFloat32Value)
+	return &t
+}
+
+func (s *Float32Stream) Get() (float32, error) {
+	v, err := s.getDecoded(decodeFloat32Value)
+	value, _ := v.(float32)
+	return value, err
+}
+
+func (s *Float32Stream) Updates() <-chan float32 {
+	return s.updates
+}
+
+type Int32Stream struct {
+	*Stream
+	updates chan int32
+}
+
+func (s *Stream) AsInt32() *Int32Stream {
+	t := Int32Stream{Stream: s, updates: make(chan int32, 1)}
+	s.listenDecoded(t.updates, decodeInt32Value)
+	return &t
+}
+
+func (s *Int32Stream) Get() (int32, error) {
+	v, err := s.getDecoded(decodeInt32Value)
+	value, _ := v.(int32)
+	return value, err
+}
+
+func (s *Int32Stream) Updates() <-chan int32 {
+	return s.updates
+}
+
+type BoolStream struct {
+	*Stream
+	updates chan bool
+}
+
+func (s *Stream) AsBool() *BoolStream {
+	t := BoolStream{Stream: s, updates: make(chan bool, 1)}
+	s.listenDecoded(t.updates, decodeBoolValue)
+	return &t
+}
+
+func (s *BoolStream) Get() (bool, error) {
+	v, err := s.getDecoded(decodeBoolValue)
+	value, _ := v.(bool)
+	return value, err
+}
+
+func (s *BoolStream) Updates() <-chan bool {
+	return s.updates
+}
+
+type StringStream struct {
+	*Stream
+	updates chan string
+}
+
+func (s *Stream) AsString() *StringStream {
+	t := StringStream{Stream: s, updates: make(chan string, 1)}
+	s.listenDecoded(t.updates, decodeStringValue)
+	return &t
+}
+
+func (s *StringStream) Get() (string, error) {
+	v, err := s.getDecoded(decodeStringValue)
+	value, _ := v.(string)
+	return value, err
+}
+
+func (s *StringStream) Updates() <-chan string {
+	return s.updates
+}
+
+type VectorStream struct {
+	*Stream
+	updates chan Vector
+}
+
+func (s *Stream) AsVector() *VectorStream {
+	t := VectorStream{Stream: s, updates: make(chan Vector, 1)}
+	s.listenDecoded(t.updates, decodeVectorValue)
+	return &t
+}
+
+func (s *VectorStream) Get() (Vector, error) {
+	v, err := s.getDecoded(decodeVectorValue)
+	value, _ := v.(Vector)
+	return value, err
+}
+
+func (s *VectorStream) Updates() <-chan Vector {
+	return s.updates
+}
+
+type QuaternionStream struct {
+	*Stream
+	updates chan Quaternion
+}
+
+func (s *Stream) AsQuaternion() *QuaternionStream {
+	t := QuaternionStream{Stream: s, updates: make(chan Quaternion, 1)}
+	s.listenDecoded(t.updates, decodeQuaternionValue)
+	return &t
+}
+
+func (s *QuaternionStream) Get() (Quaternion, error) {
+	v, err := s.getDecoded(decodeQuaternionValue)
+	value, _ := v.(Quaternion)
+	return value, err
+}
+
+func (s *QuaternionStream) Updates() <-chan Quaternion {
+	return s.updates
+}
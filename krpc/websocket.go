@@ -0,0 +1,233 @@
+package krpc
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// The WebSocket servers speak the same protocol as the TCP servers, except
+// that each message is a binary WebSocket message, and the handshake is made
+// with URL query parameters: the RPC server takes the client name as "name",
+// and the stream server takes the base64-encoded client identifier as "id".
+
+// DialWebSocket connects to the kRPC RPC server over WebSockets at rawurl,
+// such as "ws://127.0.0.1:50000/", and, unless disabled with WithStream, to
+// the stream server. The stream server is assumed to be on the next port of
+// the same host unless WithStreamAddr is used to give its URL.
+func DialWebSocket(rawurl string, opts ...Option) (*Client, error) {
+	return DialWebSocketContext(context.Background(), rawurl, opts...)
+}
+
+// DialWebSocketContext is like DialWebSocket, but gives up on connecting when
+// ctx is done.
+func DialWebSocketContext(ctx context.Context, rawurl string, opts ...Option) (*Client, error) {
+	o := newOptions(opts)
+	streamURL := o.streamAddr
+	if o.stream && streamURL == "" {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		u.Host, err = defaultStreamAddr(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		streamURL = u.String()
+	}
+
+	conn, err := connectWebSocketRPC(ctx, rawurl, o.conn, o)
+	if err != nil {
+		return nil, err
+	}
+
+	dialStream := func(ctx context.Context, id []byte, conn net.Conn) (*Conn, error) {
+		return connectWebSocket(ctx, streamURL, "stream", url.Values{
+			"id": {base64.StdEncoding.EncodeToString(id)},
+		}, conn, o)
+	}
+	var stream *StreamClient
+	if o.stream {
+		streamConn, err := dialStream(ctx, conn.ID(), o.streamConn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		stream = newStreamClient(streamConn, o)
+	}
+
+	return newClient(conn, stream, o, func(ctx context.Context, id []byte) (*Conn, error) {
+		if o.streamConn != nil {
+			return nil, errNotDialed
+		}
+		return dialStream(ctx, id, nil)
+	}), nil
+}
+
+// connectWebSocketRPC opens a WebSocket connection to the RPC server at rawurl
+// and fetches the client identifier, which the WebSocket handshake does not
+// return.
+func connectWebSocketRPC(ctx context.Context, rawurl string, conn net.Conn, o options) (*Conn, error) {
+	c, err := connectWebSocket(ctx, rawurl, "rpc", url.Values{"name": {o.clientName}}, conn, o)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		c.redial = func(ctx context.Context) (*Conn, error) {
+			return connectWebSocketRPC(ctx, rawurl, nil, o)
+		}
+	}
+
+	// The connection has no reader yet, so the call is made directly.
+	stop := watchContext(ctx, c.conn.SetDeadline)
+	defer stop()
+	_, err = c.Send(&pb.Request{
+		Calls: []*pb.ProcedureCall{
+			&pb.ProcedureCall{Service: "KRPC", Procedure: "GetClientID"},
+		},
+	})
+	if err != nil {
+		c.conn.Close()
+		return nil, contextError(ctx, err)
+	}
+	res := pb.Response{}
+	err = c.Read(&res)
+	if err != nil {
+		c.conn.Close()
+		return nil, contextError(ctx, err)
+	}
+	if e := res.GetError(); e != nil {
+		c.conn.Close()
+		return nil, newError(e)
+	}
+	if len(res.GetResults()) != 1 {
+		c.conn.Close()
+		return nil, errors.Errorf("GetClientID returned %d results", len(res.GetResults()))
+	}
+	if e := res.GetResults()[0].GetError(); e != nil {
+		c.conn.Close()
+		return nil, newError(e)
+	}
+	c.id, err = DecodeBytes(res.GetResults()[0].GetValue())
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connectWebSocket opens a WebSocket connection of the given kind, "rpc" or
+// "stream", to rawurl with query added to its query parameters. If conn is not
+// nil, the WebSocket handshake is performed over it instead of a new
+// connection.
+func connectWebSocket(ctx context.Context, rawurl, kind string, query url.Values, conn net.Conn, o options) (*Conn, error) {
+	if o.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.dialTimeout)
+		defer cancel()
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	// The dialer only gives up on a handshake at the context's deadline, so
+	// the connection is also watched for the context being canceled.
+	var stop func()
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c := conn
+			if c == nil {
+				var err error
+				c, err = o.dial(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+			}
+			stop = watchContext(ctx, c.SetDeadline)
+			return c, nil
+		},
+	}
+	if conn == nil {
+		d.Proxy = o.proxy
+	}
+	ws, res, err := d.DialContext(ctx, u.String(), nil)
+	if stop != nil {
+		stop()
+	}
+	if err == websocket.ErrBadHandshake {
+		err = errors.Errorf("WebSocket handshake failed: %s", res.Status)
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, contextError(ctx, err)
+	}
+
+	c := newConn(ws.UnderlyingConn(), &websocketFramer{ws: ws}, u.Host, o)
+	c.kind = kind
+	c.log.Log(LevelInfo, "connected", Field{"url", u.String()})
+	return c, nil
+}
+
+// websocketFramer sends each message as a binary WebSocket message. Pings are
+// answered by the connection while reading, which may happen alongside
+// writes, but writes are serialized.
+type websocketFramer struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (f *websocketFramer) WriteMessage(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (f *websocketFramer) ReadMessage(max uint64) ([]byte, error) {
+	if max > math.MaxInt64 {
+		max = math.MaxInt64
+	}
+	f.ws.SetReadLimit(int64(max))
+
+	_, r, err := f.ws.NextReader()
+	if err != nil {
+		return nil, websocketError(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, websocketError(err)
+	}
+	return data, nil
+}
+
+// websocketError converts the end of a WebSocket connection into io.EOF, and
+// a message over the size limit into a FrameError. The size of such a message
+// is not known, since it may be split across frames.
+func websocketError(err error) error {
+	if _, ok := err.(*websocket.CloseError); ok {
+		return io.EOF
+	}
+	if err == websocket.ErrReadLimit {
+		return &FrameError{Err: ErrMessageTooLarge}
+	}
+	return err
+}
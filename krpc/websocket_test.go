@@ -0,0 +1,298 @@
+package krpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+
+	"github.com/ilikebits/jeb/krpc/pb"
+)
+
+// websocketFront is a WebSocket front end to a server's TCP protocol. It
+// makes the handshake for each WebSocket connection with the parameters in
+// its URL, then relays each WebSocket message as a TCP message frame, and
+// each TCP message frame as a WebSocket message.
+type websocketFront struct {
+	*httptest.Server
+	addr string
+	typ  pb.ConnectionRequest_Type
+}
+
+func newWebSocketFront(addr string, typ pb.ConnectionRequest_Type) *websocketFront {
+	f := &websocketFront{addr: addr, typ: typ}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.relay))
+	return f
+}
+
+// URL returns the WebSocket URL of the front end.
+func (f *websocketFront) URL() string {
+	return "ws://" + f.Listener.Addr().String() + "/"
+}
+
+func (f *websocketFront) relay(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	id, err := base64.StdEncoding.DecodeString(query.Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	server, err := net.Dial("tcp", f.addr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer server.Close()
+	serverReader := bufio.NewReader(server)
+	writeTestMessage(server, &pb.ConnectionRequest{
+		Type:             f.typ,
+		ClientName:       query.Get("name"),
+		ClientIdentifier: id,
+	})
+	res := pb.ConnectionResponse{}
+	if err := readTestMessage(serverReader, &res); err != nil || res.GetStatus() != pb.ConnectionResponse_OK {
+		http.Error(w, "connection refused", http.StatusBadRequest)
+		return
+	}
+
+	var upgrader websocket.Upgrader
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	go func() {
+		defer server.Close()
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			server.Write(append(proto.EncodeVarint(uint64(len(data))), data...))
+		}
+	}()
+	for {
+		size, err := binary.ReadUvarint(serverReader)
+		if err != nil {
+			return
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(serverReader, data); err != nil {
+			return
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			return
+		}
+	}
+}
+
+// webSocketServer is a test server with WebSocket front ends to its RPC and
+// stream servers.
+type webSocketServer struct {
+	*testServer
+	rpc, stream *websocketFront
+}
+
+func newWebSocketServer(t *testing.T) *webSocketServer {
+	srv := newTestServer(t)
+	handleEcho(srv)
+	srv.handle("KRPC", "GetClientID", func(*pb.ProcedureCall) *pb.ProcedureResult {
+		return &pb.ProcedureResult{Value: EncodeBytes(testClientID)}
+	})
+	return &webSocketServer{
+		testServer: srv,
+		rpc:        newWebSocketFront(srv.Addr(), pb.ConnectionRequest_RPC),
+		stream:     newWebSocketFront(srv.StreamAddr(), pb.ConnectionRequest_STREAM),
+	}
+}
+
+func (s *webSocketServer) Close() {
+	s.rpc.Close()
+	s.stream.Close()
+	s.testServer.Close()
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := newWebSocketServer(t)
+	defer srv.Close()
+	calls := make(chan string, 10)
+	handleStreams(srv.testServer, calls)
+
+	c, err := DialWebSocket(srv.rpc.URL(), WithStreamAddr(srv.stream.URL()), WithClientName("ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if name := srv.clientName(); name != "ws" {
+		t.Errorf("got client name %q, want ws", name)
+	}
+
+	// Messages larger than a small frame are sent whole.
+	for _, want := range []string{"hello", string(make([]byte, 1000)), string(make([]byte, 70000))} {
+		got, err := echo(context.Background(), c, want)
+		if err != nil || got != want {
+			t.Errorf("echo of %d bytes: got %d bytes, %v", len(want), len(got), err)
+		}
+	}
+
+	s, err := c.KRPC.AddStream(&pb.ProcedureCall{Service: "SpaceCenter", Procedure: "get_UT"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut := s.AsFloat64()
+	if err := srv.update(streamUpdate(s.ID(), EncodeFloat64(10))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-ut.Updates():
+		if v != 10 {
+			t.Errorf("got UT %v, want 10", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream update")
+	}
+}
+
+// connectProxy is an HTTP proxy that only tunnels CONNECT requests with the
+// expected credentials.
+type connectProxy struct {
+	l    net.Listener
+	auth string
+
+	mu      sync.Mutex
+	tunnels []string
+}
+
+func newConnectProxy(t *testing.T, user, password string) *connectProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &connectProxy{
+		l:    l,
+		auth: "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)),
+	}
+	go p.serve()
+	return p
+}
+
+func (p *connectProxy) Close() {
+	p.l.Close()
+}
+
+func (p *connectProxy) serve() {
+	for {
+		conn, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		go p.tunnel(conn)
+	}
+}
+
+func (p *connectProxy) tunnel(conn net.Conn) {
+	defer conn.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	if req.Method != "CONNECT" {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	if req.Header.Get("Proxy-Authorization") != p.auth {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer target.Close()
+
+	p.mu.Lock()
+	p.tunnels = append(p.tunnels, req.Host)
+	p.mu.Unlock()
+
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// url returns the URL of the proxy with the given credentials.
+func (p *connectProxy) url(user, password string) *url.URL {
+	return &url.URL{Scheme: "http", User: url.UserPassword(user, password), Host: p.l.Addr().String()}
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	srv := newWebSocketServer(t)
+	defer srv.Close()
+	proxy := newConnectProxy(t, "kerbal", "jeb")
+	defer proxy.Close()
+
+	c, err := DialWebSocket(srv.rpc.URL(),
+		WithStreamAddr(srv.stream.URL()),
+		WithProxy(http.ProxyURL(proxy.url("kerbal", "jeb"))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got, err := echo(context.Background(), c, "hello"); err != nil || got != "hello" {
+		t.Errorf("echo: got %q, %v, want hello", got, err)
+	}
+
+	rpc := srv.rpc.Listener.Addr().String()
+	stream := srv.stream.Listener.Addr().String()
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if len(proxy.tunnels) != 2 || proxy.tunnels[0] != rpc || proxy.tunnels[1] != stream {
+		t.Errorf("got tunnels %v, want [%s %s]", proxy.tunnels, rpc, stream)
+	}
+}
+
+func TestWebSocketProxyRejected(t *testing.T) {
+	srv := newWebSocketServer(t)
+	defer srv.Close()
+	proxy := newConnectProxy(t, "kerbal", "jeb")
+	defer proxy.Close()
+
+	_, err := DialWebSocket(srv.rpc.URL(),
+		WithStream(false),
+		WithProxy(http.ProxyURL(proxy.url("kerbal", "wrong"))),
+	)
+	if err == nil {
+		t.Fatal("connected through a proxy with the wrong credentials")
+	}
+}
+
+func TestWebSocketNoProxy(t *testing.T) {
+	srv := newWebSocketServer(t)
+	defer srv.Close()
+
+	c, err := DialWebSocket(srv.rpc.URL(), WithStream(false), WithProxy(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := echo(context.Background(), c, "hello"); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"time"
+	"os"
+	"strings"
 
 	"github.com/ilikebits/jeb/krpc"
 )
@@ -15,14 +18,69 @@ func main() {
 
 	// Parse flags.
 	addr := flag.String("addr", "127.0.0.1:50000", "server TCP address")
+	streamAddr := flag.String("stream-addr", "127.0.0.1:50001", "stream server TCP address")
+	trace := flag.Bool("trace", false, "log every message sent and received")
+	record := flag.String("record", "", "record the session to a file")
+	replay := flag.String("replay", "", "replay a recorded session instead of connecting")
+	call := flag.String("call", "", "call a procedure, such as SpaceCenter.get_UT, with JSON arguments and exit")
 	flag.Parse()
 
+	// Exit with an error status once the deferred calls have run.
+	failed := false
+	defer func() {
+		if failed {
+			os.Exit(1)
+		}
+	}()
+
 	// Dial client.
-	c, err := krpc.Dial(*addr)
+	level := krpc.LevelInfo
+	if *trace {
+		level = krpc.LevelDebug
+	}
+	opts := []krpc.Option{
+		krpc.WithStreamAddr(*streamAddr),
+		krpc.WithLogger(krpc.StdLogger(nil, level)),
+		krpc.WithWireTrace(*trace),
+	}
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		opts = append(opts, krpc.WithRecorder(krpc.NewRecorder(f)))
+	}
+	if *replay != "" {
+		f, err := os.Open(*replay)
+		if err != nil {
+			panic(err)
+		}
+		session, err := krpc.ReadSession(f)
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts,
+			krpc.WithConn(session.Conn(krpc.ReplayInOrder)),
+			krpc.WithStreamConn(session.StreamConn()),
+		)
+	}
+	c, err := krpc.Dial(*addr, opts...)
 	if err != nil {
 		panic(err)
 	}
 
+	if *call != "" {
+		err := invoke(c, *call, flag.Args())
+		c.Close()
+		if err != nil {
+			log.Print(err)
+			failed = true
+		}
+		return
+	}
+
 	// Call KRPC.GetStatus()
 	stat, err := c.KRPC.GetStatus()
 	if err != nil {
@@ -30,28 +88,62 @@ func main() {
 	}
 	log.Printf("%#v", stat)
 
-	// Call KRPC.SpaceCenter.ActiveVessel()
-	v, err := c.Vessel()
+	// Call SpaceCenter.ActiveVessel()
+	v, err := c.SpaceCenter().ActiveVessel()
 	if err != nil {
 		panic(err)
 	}
 	log.Printf("%#v", v)
 
 	// Call vessel.Flight()
-	f, err := v.Flight()
+	ref, err := v.SurfaceReferenceFrame()
+	if err != nil {
+		panic(err)
+	}
+	f, err := v.Flight(ref)
 	if err != nil {
 		panic(err)
 	}
 	log.Printf("%#v", f)
 
+	// Stream flight.SurfaceAltitude()
+	s, err := c.KRPC.AddStream(f.SurfaceAltitudeCall(), true)
+	if err != nil {
+		panic(err)
+	}
+	alt := s.AsFloat64()
+
 	for {
-		// Call flight.SurfaceAltitude()
-		a, err := f.SurfaceAltitude()
+		select {
+		case a := <-alt.Updates():
+			fmt.Printf("%#v\n", a)
+		case <-c.Stream.Done():
+			panic(c.Stream.Err())
+		}
+	}
+}
+
+// invoke calls a procedure named "Service.Procedure" with arguments given as
+// JSON values, and prints its return value.
+func invoke(c *krpc.Client, name string, jsonArgs []string) error {
+	dot := strings.Index(name, ".")
+	if dot < 0 {
+		return fmt.Errorf("procedure %q is not of the form Service.Procedure", name)
+	}
+	var args []interface{}
+	for _, a := range jsonArgs {
+		var arg interface{}
+		err := json.Unmarshal([]byte(a), &arg)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("argument %s: %v", a, err)
 		}
-		fmt.Printf("%#v\n", a)
+		args = append(args, arg)
+	}
 
-		time.Sleep(1 * time.Millisecond)
+	v, err := c.Invoke(context.Background(), name[:dot], name[dot+1:], args...)
+	if err != nil {
+		return err
 	}
+	fmt.Printf("%#v\n", v.Interface())
+	return nil
 }